@@ -0,0 +1,182 @@
+package blockchain
+
+import "github.com/savecomdev/blockchain-pow-go/wallet"
+
+const addrIndexFlag = "addrindex"
+
+// What a main chain transaction did to an address, stored into the address index
+type AddrEvent struct {
+	TxID      []byte
+	BlockHash []byte
+	Height    int
+	Received  int
+	Sent      int
+}
+
+// Entry of the history of an address, Balance is the balance once the
+// transaction is applied
+type AddrHistoryEntry struct {
+	AddrEvent
+	Balance int
+}
+
+func (event AddrEvent) Serialize() []byte {
+	return encode(event)
+}
+
+func DeserializeAddrEvent(data []byte) (AddrEvent, error) {
+	var event AddrEvent
+	err := decode(data, &event)
+	return event, err
+}
+
+// Position of an event into the address index
+type addrEventKey struct {
+	pubKeyHash string
+	position   int
+}
+
+// Compute what every transaction of the block did to the addresses it
+// touched, the spent amounts come from the undo data of the block
+func blockAddrEvents(block *Block, undo *BlockUndo) map[addrEventKey]*AddrEvent {
+	events := make(map[addrEventKey]*AddrEvent)
+	spent := 0
+
+	event := func(pubKeyHash []byte, pos int, tx *Transaction) *AddrEvent {
+		key := addrEventKey{string(pubKeyHash), pos}
+		if events[key] == nil {
+			events[key] = &AddrEvent{tx.ID, block.Hash, block.Height, 0, 0}
+		}
+		return events[key]
+	}
+
+	for pos, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				if undo != nil && spent < len(undo.Spent) {
+					out := undo.Spent[spent]
+					event(out.PubKeyHash, pos, tx).Sent += out.Value
+				} else {
+					event(wallet.PublicKeyHash(in.PubKey), pos, tx)
+				}
+				spent++
+			}
+		}
+
+		for _, out := range tx.Outputs {
+			event(out.PubKeyHash, pos, tx).Received += out.Value
+		}
+	}
+
+	return events
+}
+
+// Check if the address index is kept by the chain
+func (chain *BlockChain) HasAddrIndex() bool {
+	found := false
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		found, err = txn.HasFlag(addrIndexFlag)
+		return err
+	})
+	return err == nil && found
+}
+
+// Index the addresses touched by the main chain and keep the index up to
+// date from now on, the choice is stored with the chain
+func (chain *BlockChain) EnableAddrIndex() error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+
+	if chain.addrIndex {
+		return nil
+	}
+
+	iter := chain.ForwardIterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			break
+		}
+
+		undo, err := chain.GetBlockUndo(block)
+		if err != nil {
+			return err
+		}
+
+		err = chain.Store.Update(func(txn StoreTxn) error {
+			return indexBlockAddresses(txn, block, undo)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := chain.Store.Update(func(txn StoreTxn) error {
+		return txn.SetFlag(addrIndexFlag)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.addrIndex = true
+
+	return nil
+}
+
+// Add the events of a block joining the main chain into the index
+func indexBlockAddresses(txn StoreTxn, block *Block, undo *BlockUndo) error {
+	for key, event := range blockAddrEvents(block, undo) {
+		if err := txn.PutAddrEvent([]byte(key.pubKeyHash), block.Height, key.position, *event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the events of a block leaving the main chain from the index, the
+// keys only depend on the block so no undo data is needed
+func unindexBlockAddresses(txn StoreTxn, block *Block) error {
+	for key := range blockAddrEvents(block, nil) {
+		if err := txn.DeleteAddrEvent([]byte(key.pubKeyHash), block.Height, key.position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the history of an address from its first transaction, skip and count
+// select a page of the history
+func (chain *BlockChain) GetAddressHistory(pubKeyHash []byte, skip, count int) ([]AddrHistoryEntry, error) {
+	var history []AddrHistoryEntry
+
+	if !chain.addrIndex {
+		return nil, ErrNoAddrIndex
+	}
+
+	err := chain.Store.View(func(txn StoreTxn) error {
+		balance := 0
+		index := 0
+
+		// the running balance needs every event before the page
+		return txn.ForEachAddrEvent(pubKeyHash, func(event AddrEvent) error {
+			if index >= skip+count {
+				return ErrStopIteration
+			}
+
+			balance += event.Received - event.Sent
+
+			if index >= skip {
+				history = append(history, AddrHistoryEntry{event, balance})
+			}
+			index++
+
+			return nil
+		})
+	})
+
+	return history, err
+}
@@ -0,0 +1,621 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/savecomdev/blockchain-pow-go/codec"
+)
+
+// Layout of the keys into the DB, the block headers are stored under their
+// hash
+var (
+	tipKey          = []byte("lh")
+	bodyPrefix      = []byte("body-")
+	workPrefix      = []byte("work-")
+	undoPrefix      = []byte("undo-")
+	heightPrefix    = []byte("height-")
+	utxoPrefix      = []byte("utxo-")
+	txIndexPrefix   = []byte("tx-")
+	addrIndexPrefix = []byte("addr-")
+	// version of the encoding of the values, missing from the databases
+	// written with gob
+	encodingKey = []byte("encoding")
+)
+
+// Number of values rewritten by one transaction of the migration
+const migrationBatch = 1000
+
+// ChainStore kept into a Badger DB
+type BadgerStore struct {
+	DB *badger.DB
+}
+
+type badgerTxn struct {
+	txn *badger.Txn
+}
+
+// Check the file link to the DB
+func existDB(path string) bool {
+	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+// Retry on open the DB instance
+func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
+	lockPath := filepath.Join(dir, "LOCK")
+	if err := os.Remove(lockPath); err != nil {
+		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	}
+
+	retryOpts := originalOpts
+	retryOpts.Truncate = true
+
+	db, err := badger.Open(retryOpts)
+	return db, err
+}
+
+// Open the DB instance
+func openDB(dir string, opts badger.Options) (*badger.DB, error) {
+	if db, err := badger.Open(opts); err != nil {
+		if strings.Contains(err.Error(), "LOCK") {
+			if db, err := retry(dir, opts); err == nil {
+				log.Println("Database unlocked, value log truncated")
+				return db, nil
+			}
+			log.Println("Could not unlock database:", err)
+		}
+		return nil, err
+	} else {
+		return db, nil
+	}
+}
+
+// Open the Badger DB at the path, it is created when missing
+func NewBadgerStore(path string) (*BadgerStore, error) {
+	// the data directory of the network may not exist yet
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	// configure the database
+	opts := badger.DefaultOptions(path)
+
+	// open the database
+	db, err := openDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateEncoding(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BadgerStore{db}, nil
+}
+
+// Rewrite the values of a database written with gob into the canonical
+// encoding, the raw values (tip, work, heights, flags) are kept as they are.
+// The version is stored last so an interrupted migration starts again.
+func migrateEncoding(db *badger.DB) error {
+	var version []byte
+	var stored bool
+
+	err := db.View(func(txn *badger.Txn) error {
+		t := &badgerTxn{txn}
+
+		var err error
+		if version, err = t.get(encodingKey); err != nil {
+			return err
+		}
+
+		tip, err := t.get(tipKey)
+		stored = tip != nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if version != nil {
+		if len(version) != 1 || version[0] != codec.Version {
+			return fmt.Errorf("Unknown encoding %x of the database", version)
+		}
+		return nil
+	}
+
+	if stored {
+		log.Println("Migrating the database to the canonical encoding")
+
+		var keys [][]byte
+		err = db.View(func(txn *badger.Txn) error {
+			return (&badgerTxn{txn}).forEach(nil, false, func(key, _ []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		for start := 0; start < len(keys); start += migrationBatch {
+			end := start + migrationBatch
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			err := db.Update(func(txn *badger.Txn) error {
+				t := &badgerTxn{txn}
+
+				for _, key := range keys[start:end] {
+					data, err := t.get(key)
+					if err != nil {
+						return err
+					}
+
+					// the headers are stored under the hash of their block
+					if len(key) == sha256.Size {
+						if err := migrateBlock(t, key, data); err != nil {
+							return fmt.Errorf("Migrating the block %x: %w", key, err)
+						}
+						continue
+					}
+
+					migrated, changed, err := migrateValue(key, data)
+					if err != nil {
+						return fmt.Errorf("Migrating the key %x: %w", key, err)
+					}
+					if !changed {
+						continue
+					}
+
+					if err := txn.Set(key, migrated); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Database migrated, %d keys checked", len(keys))
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set(encodingKey, []byte{codec.Version})
+	})
+}
+
+// Get the canonical encoding of a value encoded with gob, changed is false
+// for the raw values and the ones already migrated
+func migrateValue(key, data []byte) (migrated []byte, changed bool, err error) {
+	switch {
+	case bytes.HasPrefix(key, bodyPrefix):
+		return recode(data, &blockBody{})
+	case bytes.HasPrefix(key, undoPrefix):
+		return recodeUndo(data)
+	case bytes.HasPrefix(key, utxoPrefix):
+		return recode(data, &TxOutputs{})
+	case bytes.HasPrefix(key, txIndexPrefix):
+		return recode(data, &TxLocation{})
+	case bytes.HasPrefix(key, addrIndexPrefix):
+		return recode(data, &AddrEvent{})
+	case bytes.HasPrefix(key, workPrefix), bytes.HasPrefix(key, heightPrefix):
+		return nil, false, nil
+	}
+	return nil, false, nil
+}
+
+// Block stored with gob under its hash. Before the headers were split from
+// the bodies the whole block was stored there with its difficulty under
+// another name, or none at all for the first version. A header stored alone
+// has no transactions.
+type legacyBlock struct {
+	Version      int
+	PrevHash     []byte
+	MerkleRoot   []byte
+	Timestamp    int64
+	Bits         int
+	Difficulty   int
+	Nonce        int
+	Height       int
+	Transactions []*Transaction
+}
+
+// Difficulty of the blocks written by the first version
+const legacyDifficulty = 12
+
+// Rewrite the header stored under the hash of its block, the transactions of
+// a whole block are moved to its body
+func migrateBlock(t *badgerTxn, hash, data []byte) error {
+	if _, err := DeserializeHeader(data); err == nil {
+		return nil
+	}
+
+	var legacy legacyBlock
+	if err := gobDecode(data, &legacy); err != nil {
+		return err
+	}
+
+	header := BlockHeader{
+		Version:    legacy.Version,
+		PrevHash:   legacy.PrevHash,
+		MerkleRoot: legacy.MerkleRoot,
+		Timestamp:  legacy.Timestamp,
+		Bits:       legacy.Bits,
+		Nonce:      legacy.Nonce,
+		Height:     legacy.Height,
+	}
+	if header.Bits == 0 {
+		header.Bits = legacy.Difficulty
+	}
+	if header.Bits == 0 {
+		header.Bits = legacyDifficulty
+	}
+
+	if len(legacy.Transactions) > 0 {
+		block := &Block{header, hash, legacy.Transactions}
+		if len(header.MerkleRoot) == 0 {
+			header.MerkleRoot = block.HashTransaction()
+		}
+		if err := t.txn.Set(prefixedKey(bodyPrefix, hash), serializeBody(legacy.Transactions)); err != nil {
+			return err
+		}
+	}
+
+	return t.PutHeader(hash, &header)
+}
+
+func recode(data []byte, value interface{}) ([]byte, bool, error) {
+	if decode(data, value) == nil {
+		return nil, false, nil
+	}
+
+	// gob keeps the fields it doesn't carry, clear what the failed decoding set
+	v := reflect.ValueOf(value).Elem()
+	v.Set(reflect.Zero(v.Type()))
+
+	if err := gobDecode(data, value); err != nil {
+		return nil, false, err
+	}
+	return encode(value), true, nil
+}
+
+// The undo data encoded with gob didn't keep the height of the spent outputs,
+// it is set when the chain is loaded
+func recodeUndo(data []byte) ([]byte, bool, error) {
+	if decode(data, &BlockUndo{}) == nil {
+		return nil, false, nil
+	}
+
+	var legacy struct {
+		Spent []TxOutput
+	}
+	if err := gobDecode(data, &legacy); err != nil {
+		return nil, false, err
+	}
+
+	undo := &BlockUndo{}
+	for _, out := range legacy.Spent {
+		undo.Spent = append(undo.Spent, SpentOutput{TxOutput: out})
+	}
+	return encode(undo), true, nil
+}
+
+func (s *BadgerStore) View(fn func(txn StoreTxn) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn})
+	})
+}
+
+func (s *BadgerStore) Update(fn func(txn StoreTxn) error) error {
+	return s.DB.Update(func(txn *badger.Txn) error {
+		return fn(&badgerTxn{txn})
+	})
+}
+
+func (s *BadgerStore) Close() error {
+	return s.DB.Close()
+}
+
+// Build a key from a prefix and an ID
+func prefixedKey(prefix, ID []byte) []byte {
+	key := make([]byte, 0, len(prefix)+len(ID))
+	key = append(key, prefix...)
+	return append(key, ID...)
+}
+
+// Build the key of a height into the index, the height is big endian so the
+// keys are sorted by height
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+	return key
+}
+
+// Build the key of an event into the address index, the events of an address
+// are sorted by height then by position into the block
+func addrIndexKey(pubKeyHash []byte, height, position int) []byte {
+	var pos [12]byte
+	binary.BigEndian.PutUint64(pos[:8], uint64(height))
+	binary.BigEndian.PutUint32(pos[8:], uint32(position))
+
+	return append(prefixedKey(addrIndexPrefix, pubKeyHash), pos[:]...)
+}
+
+// Get the value of the key, nil when the key is not stored
+func (t *badgerTxn) get(key []byte) ([]byte, error) {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+// Call fn on every key starting by the prefix
+func (t *badgerTxn) forEach(prefix []byte, values bool, fn func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = values
+
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+
+		var value []byte
+		if values {
+			var err error
+			if value, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+
+		if err := fn(item.KeyCopy(nil), value); err == ErrStopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *badgerTxn) GetBlock(hash []byte) (*Block, error) {
+	header, err := t.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := t.get(prefixedKey(bodyPrefix, hash))
+	if err != nil {
+		return nil, err
+	}
+	if header == nil || data == nil {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+
+	txs, err := deserializeBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{*header, append([]byte{}, hash...), txs}, nil
+}
+
+// A block is stored once its body is
+func (t *badgerTxn) HasBlock(hash []byte) (bool, error) {
+	_, err := t.txn.Get(prefixedKey(bodyPrefix, hash))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (t *badgerTxn) PutBlock(block *Block) error {
+	if err := t.PutHeader(block.Hash, &block.BlockHeader); err != nil {
+		return err
+	}
+	return t.txn.Set(prefixedKey(bodyPrefix, block.Hash), serializeBody(block.Transactions))
+}
+
+func (t *badgerTxn) GetHeader(hash []byte) (*BlockHeader, error) {
+	data, err := t.get(hash)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return DeserializeHeader(data)
+}
+
+func (t *badgerTxn) PutHeader(hash []byte, header *BlockHeader) error {
+	return t.txn.Set(hash, header.Serialize())
+}
+
+func (t *badgerTxn) GetTip() ([]byte, error) {
+	hash, err := t.get(tipKey)
+	if err == nil && hash == nil {
+		return nil, ErrChainNotFound
+	}
+	return hash, err
+}
+
+func (t *badgerTxn) SetTip(hash []byte) error {
+	return t.txn.Set(tipKey, hash)
+}
+
+func (t *badgerTxn) GetWork(hash []byte) (*big.Int, error) {
+	data, err := t.get(prefixedKey(workPrefix, hash))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (t *badgerTxn) PutWork(hash []byte, work *big.Int) error {
+	return t.txn.Set(prefixedKey(workPrefix, hash), work.Bytes())
+}
+
+func (t *badgerTxn) GetUndo(hash []byte) (*BlockUndo, error) {
+	data, err := t.get(prefixedKey(undoPrefix, hash))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return DeserializeUndo(data)
+}
+
+func (t *badgerTxn) PutUndo(hash []byte, undo *BlockUndo) error {
+	return t.txn.Set(prefixedKey(undoPrefix, hash), undo.Serialize())
+}
+
+func (t *badgerTxn) GetHashByHeight(height int) ([]byte, error) {
+	hash, err := t.get(heightKey(height))
+	if err == nil && hash == nil {
+		return nil, fmt.Errorf("%w: %d", ErrHeightNotFound, height)
+	}
+	return hash, err
+}
+
+func (t *badgerTxn) PutHeight(height int, hash []byte) error {
+	return t.txn.Set(heightKey(height), hash)
+}
+
+func (t *badgerTxn) DeleteHeight(height int) error {
+	return t.txn.Delete(heightKey(height))
+}
+
+// Read the last key of the height index
+func (t *badgerTxn) BestHeight() (int, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+
+	it := t.txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Seek(heightKey(math.MaxInt64))
+	if !it.ValidForPrefix(heightPrefix) {
+		return 0, ErrHeightNotFound
+	}
+
+	return int(binary.BigEndian.Uint64(it.Item().Key()[len(heightPrefix):])), nil
+}
+
+func (t *badgerTxn) GetOutputs(txID []byte) (TxOutputs, bool, error) {
+	data, err := t.get(prefixedKey(utxoPrefix, txID))
+	if err != nil || data == nil {
+		return TxOutputs{}, false, err
+	}
+	outs, err := DeserializeOutputs(data)
+	return outs, err == nil, err
+}
+
+func (t *badgerTxn) PutOutputs(txID []byte, outs TxOutputs) error {
+	return t.txn.Set(prefixedKey(utxoPrefix, txID), outs.Serialize())
+}
+
+func (t *badgerTxn) DeleteOutputs(txID []byte) error {
+	return t.txn.Delete(prefixedKey(utxoPrefix, txID))
+}
+
+func (t *badgerTxn) ForEachOutputs(fn func(txID []byte, outs TxOutputs) error) error {
+	return t.forEach(utxoPrefix, true, func(key, value []byte) error {
+		outs, err := DeserializeOutputs(value)
+		if err != nil {
+			return err
+		}
+		return fn(bytes.TrimPrefix(key, utxoPrefix), outs)
+	})
+}
+
+func (t *badgerTxn) ClearOutputs() error {
+	var keys [][]byte
+
+	err := t.forEach(utxoPrefix, false, func(key, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := t.txn.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *badgerTxn) GetTxLocation(txID []byte) (*TxLocation, error) {
+	data, err := t.get(prefixedKey(txIndexPrefix, txID))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	loc, err := DeserializeTxLocation(data)
+	if err != nil {
+		return nil, err
+	}
+	return &loc, nil
+}
+
+func (t *badgerTxn) PutTxLocation(txID []byte, loc TxLocation) error {
+	return t.txn.Set(prefixedKey(txIndexPrefix, txID), loc.Serialize())
+}
+
+func (t *badgerTxn) DeleteTxLocation(txID []byte) error {
+	return t.txn.Delete(prefixedKey(txIndexPrefix, txID))
+}
+
+func (t *badgerTxn) PutAddrEvent(pubKeyHash []byte, height, position int, event AddrEvent) error {
+	return t.txn.Set(addrIndexKey(pubKeyHash, height, position), event.Serialize())
+}
+
+func (t *badgerTxn) DeleteAddrEvent(pubKeyHash []byte, height, position int) error {
+	return t.txn.Delete(addrIndexKey(pubKeyHash, height, position))
+}
+
+func (t *badgerTxn) ForEachAddrEvent(pubKeyHash []byte, fn func(event AddrEvent) error) error {
+	prefix := prefixedKey(addrIndexPrefix, pubKeyHash)
+
+	return t.forEach(prefix, true, func(key, value []byte) error {
+		// the keys of a longer public key hash share the prefix
+		if len(key) != len(prefix)+12 {
+			return nil
+		}
+
+		event, err := DeserializeAddrEvent(value)
+		if err != nil {
+			return err
+		}
+		return fn(event)
+	})
+}
+
+func (t *badgerTxn) HasFlag(name string) (bool, error) {
+	value, err := t.get([]byte(name))
+	return value != nil, err
+}
+
+func (t *badgerTxn) SetFlag(name string) error {
+	return t.txn.Set([]byte(name), []byte{1})
+}
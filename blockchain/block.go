@@ -2,75 +2,181 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
-	"log"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"time"
 )
 
+// Version of the blocks created by this node
+const BlockVersion = 1
+
+// Part of the block covered by the proof of work, the transactions are
+// committed to by the Merkle root. The hash covers the fields in the order of
+// Bytes, the storage and the wire use the canonical encoding of the fields
+// in their order.
+type BlockHeader struct {
+	Version    int
+	PrevHash   []byte
+	MerkleRoot []byte
+	Timestamp  int64
+	// difficulty, as leading zero bits of the hash
+	Bits   int
+	Nonce  int
+	Height int
+}
+
 type Block struct {
-	Timestamp    int64
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
-	Height       int
 }
 
-func ErrorHandler(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
+// Mine a block on every CPU
+func CreateBlock(txs []*Transaction, prevHash []byte, height, difficulty int) *Block {
+	// without a cancellation the search always ends on a valid hash
+	block, _ := CreateBlockContext(context.Background(), txs, prevHash, height, difficulty, 0)
+	return block
 }
 
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
+// Mine a block on the workers until the context is done, 0 workers means one
+// worker per CPU
+func CreateBlockContext(ctx context.Context, txs []*Transaction, prevHash []byte, height, difficulty, workers int) (*Block, error) {
+	block := NewBlock(txs, prevHash, height, difficulty)
+	if _, err := block.Mine(ctx, workers); err != nil {
+		return nil, err
+	}
 
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+	return block, nil
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+// Build a block which isn't mined yet, it gets its nonce and its hash from
+// Mine
+func NewBlock(txs []*Transaction, prevHash []byte, height, difficulty int) *Block {
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:   BlockVersion,
+			PrevHash:  prevHash,
+			Timestamp: time.Now().Unix(),
+			Bits:      difficulty,
+			Height:    height,
+		},
+		Transactions: txs,
+	}
+	block.MerkleRoot = block.HashTransaction()
 
 	return block
 }
 
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0)
-}
-
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
+// Search the nonce of the block on the workers until the context is done,
+// the proof of work counts the hashes it took
+func (b *Block) Mine(ctx context.Context, workers int) (*ProofOfWork, error) {
+	pow := NewProof(b)
+	nonce, hash, err := pow.RunContext(ctx, workers)
+	if err != nil {
+		return nil, err
+	}
 
-	encoder := gob.NewEncoder(&res)
+	b.Hash = hash
+	b.Nonce = nonce
 
-	err := encoder.Encode(b)
+	return pow, nil
+}
 
-	ErrorHandler(err)
+func Genesis(coinbase *Transaction, difficulty int) *Block {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, difficulty)
+}
 
-	return res.Bytes()
+func (b *Block) Serialize() []byte {
+	return encode(b)
 }
 
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := decoder.Decode(&block)
-
-	ErrorHandler(err)
+	if err := decode(data, &block); err != nil {
+		return nil, err
+	}
 
-	return &block
+	return &block, nil
 }
 
+// Compute the Merkle root of the IDs of the transactions, an ID already
+// covers the signatures of its transaction
 func (b *Block) HashTransaction() []byte {
 	var txHashes [][]byte
 
 	// populate the maps of transaction hashes
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.Serialize())
+		txHashes = append(txHashes, tx.ID)
 	}
 
 	// create a tree nodes
 	tree := NewMerkleTree(txHashes)
 	return tree.RootNode.Data
 }
+
+// Get the data hashed by the proof of work, the nonce is the last 8 bytes
+func (h *BlockHeader) Bytes() []byte {
+	var buff bytes.Buffer
+
+	// the genesis block has no previous hash, it is kept fixed size
+	prevHash := h.PrevHash
+	if len(prevHash) == 0 {
+		prevHash = make([]byte, sha256.Size)
+	}
+
+	buff.Write(ToHex(int64(h.Version)))
+	buff.Write(prevHash)
+	buff.Write(h.MerkleRoot)
+	buff.Write(ToHex(h.Timestamp))
+	buff.Write(ToHex(int64(h.Bits)))
+	buff.Write(ToHex(int64(h.Height)))
+	buff.Write(ToHex(int64(h.Nonce)))
+
+	return buff.Bytes()
+}
+
+// Compute the hash of the header, it is the hash of the block
+func (h *BlockHeader) ComputeHash() []byte {
+	hash := sha256.Sum256(h.Bytes())
+	return hash[:]
+}
+
+// Set the nonce into the data returned by Bytes
+func putNonce(data []byte, nonce int) {
+	binary.BigEndian.PutUint64(data[len(data)-8:], uint64(nonce))
+}
+
+func (h *BlockHeader) Serialize() []byte {
+	return encode(h)
+}
+
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	var header BlockHeader
+
+	if err := decode(data, &header); err != nil {
+		return nil, err
+	}
+
+	return &header, nil
+}
+
+// Transactions of a block, stored apart from its header
+type blockBody struct {
+	Transactions []*Transaction
+}
+
+func serializeBody(txs []*Transaction) []byte {
+	return encode(blockBody{txs})
+}
+
+func deserializeBody(data []byte) ([]*Transaction, error) {
+	var body blockBody
+
+	if err := decode(data, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Transactions, nil
+}
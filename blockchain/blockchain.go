@@ -2,239 +2,359 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
-
-	"github.com/dgraph-io/badger"
-)
-
-const (
-	dbPath = "./tmp/blocks_%s"
+	"sync"
 )
 
 type BlockChain struct {
 	LastHash []byte
-	Database *badger.DB
+	Store    ChainStore
+	Params   *ChainParams
+
+	// keep the optional indexes up to date
+	txIndex   bool
+	addrIndex bool
+
+	// serialize the changes of the tip
+	lock            sync.Mutex
+	subscribers     []func(*Notification)
+	subscribersLock sync.RWMutex
+	// guards LastHash for the readers not holding lock
+	tipLock sync.RWMutex
 }
 
-// Check the file link to the DB
-func existDB(path string) bool {
-	if _, err := os.Stat(path + "/MANIFEST"); os.IsNotExist(err) {
-		return false
+// Initialization the chain for the address
+func InitBlockChain(params *ChainParams, address, nodeID string) (*BlockChain, error) {
+	path := params.ChainPath(nodeID)
+	if existDB(path) {
+		return nil, ErrChainExists
 	}
-	return true
-}
 
-// Retry on open the DB instance
-func retry(dir string, originalOpts badger.Options) (*badger.DB, error) {
-	lockPath := filepath.Join(dir, "LOCK")
-	if err := os.Remove(lockPath); err != nil {
-		return nil, fmt.Errorf(`removing "LOCK": %s`, err)
+	store, err := NewBadgerStore(path)
+	if err != nil {
+		return nil, err
 	}
 
-	retryOpts := originalOpts
-	retryOpts.Truncate = true
+	chain, err := NewBlockChain(store, params, address)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-	db, err := badger.Open(retryOpts)
-	return db, err
+	return chain, nil
 }
 
-// Open the DB instance
-func openDB(dir string, opts badger.Options) (*badger.DB, error) {
-	if db, err := badger.Open(opts); err != nil {
-		if strings.Contains(err.Error(), "LOCK") {
-			if db, err := retry(dir, opts); err != nil {
-				log.Println("Database unlocked, value log truncated")
-				return db, nil
-			}
-			log.Println("Could not unlock database:", err)
-		}
+// Get the  current chain for the address
+func CountinueBlockChain(params *ChainParams, nodeID string) (*BlockChain, error) {
+	path := params.ChainPath(nodeID)
+	if !existDB(path) {
+		return nil, ErrChainNotFound
+	}
+
+	store, err := NewBadgerStore(path)
+	if err != nil {
 		return nil, err
-	} else {
-		return db, nil
 	}
-}
 
-// Initialization the chain for the address
-func InitBlockChain(address, nodeID string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeID)
-	if existDB(path) {
-		fmt.Println("Blockchain already exists!!!")
-		runtime.Goexit()
+	chain, err := LoadBlockChain(store, params)
+	if err != nil {
+		store.Close()
+		return nil, err
 	}
 
-	var lastHash []byte
+	return chain, nil
+}
 
-	// configure the database
-	opts := badger.DefaultOptions(dbPath)
+// Create a chain into an empty store, the genesis block pays the address
+func NewBlockChain(store ChainStore, params *ChainParams, address string) (*BlockChain, error) {
+	cbtx, err := CoinBaseTx(address, params.GenesisMessage, 0, params.Subsidy(0))
+	if err != nil {
+		return nil, err
+	}
+	genesis := Genesis(cbtx, params.InitialDifficulty)
 
-	// open the database
-	db, err := openDB(path, opts)
-	ErrorHandler(err)
+	chain := &BlockChain{LastHash: genesis.Hash, Store: store, Params: params}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinBaseTx(address, "First Transaction from Genesis")
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis created")
+	// the outputs of the genesis go into the UTXO set with the block, so the
+	// chain holds its reward without a reindex
+	view := NewUTXOView(nil)
+	undo, err := view.ConnectBlock(genesis)
+	if err != nil {
+		return nil, err
+	}
+	u := UTXOSet{chain}
 
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		ErrorHandler(err)
+	err = store.Update(func(txn StoreTxn) error {
+		if _, err := txn.GetTip(); err == nil {
+			return ErrChainExists
+		} else if !errors.Is(err, ErrChainNotFound) {
+			return err
+		}
 
-		err = txn.Set([]byte("lh"), genesis.Hash)
+		if err := txn.PutBlock(genesis); err != nil {
+			return err
+		}
 
-		lastHash = genesis.Hash
+		if err := txn.PutWork(genesis.Hash, BlockWork(genesis.Bits)); err != nil {
+			return err
+		}
 
-		return err
-	})
+		if err := txn.PutHeight(genesis.Height, genesis.Hash); err != nil {
+			return err
+		}
 
-	ErrorHandler(err)
+		if err := txn.PutUndo(genesis.Hash, undo); err != nil {
+			return err
+		}
 
-	blockchain := BlockChain{lastHash, db}
+		if err := u.writeView(txn, view); err != nil {
+			return err
+		}
 
-	return &blockchain
-}
+		if err := txn.SetFlag(outputHeightsFlag); err != nil {
+			return err
+		}
 
-// Get the  current chain for the address
-func CountinueBlockChain(nodeID string) *BlockChain {
-	path := fmt.Sprintf(dbPath, nodeID)
-	if !existDB(path) {
-		fmt.Println("No existing Blockchain found, create one !!!")
-		runtime.Goexit()
+		return txn.SetTip(genesis.Hash)
+	})
+	if err != nil {
+		return nil, err
 	}
 
+	fmt.Println("Genesis created")
+
+	return chain, nil
+}
+
+// Get the chain kept into the store
+func LoadBlockChain(store ChainStore, params *ChainParams) (*BlockChain, error) {
 	var lastHash []byte
 
-	// configure the database
-	opts := badger.DefaultOptions(dbPath)
+	err := store.View(func(txn StoreTxn) (err error) {
+		lastHash, err = txn.GetTip()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// open the database
-	db, err := openDB(path, opts)
-	ErrorHandler(err)
+	chain := BlockChain{LastHash: lastHash, Store: store, Params: params}
+	chain.txIndex = chain.HasTxIndex()
+	chain.addrIndex = chain.HasAddrIndex()
+
+	// the chains stored before the height index get it built once
+	if _, err := chain.GetBlockHashByHeight(0); errors.Is(err, ErrHeightNotFound) {
+		if err := chain.buildHeightIndex(); err != nil {
+			return nil, err
+		}
+	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		ErrorHandler(err)
-		lastHash, err = item.ValueCopy(lastHash)
+	// and the ones stored before the outputs kept their height get the UTXO
+	// set and the undo data rebuilt once
+	var upToDate bool
+	err = store.View(func(txn StoreTxn) (err error) {
+		upToDate, err = txn.HasFlag(outputHeightsFlag)
 		return err
 	})
-	ErrorHandler(err)
+	if err != nil {
+		return nil, err
+	}
+	if !upToDate {
+		if err := chain.rebuildOutputs(); err != nil {
+			return nil, err
+		}
+	}
 
-	chain := BlockChain{lastHash, db}
+	return &chain, nil
+}
 
-	return &chain
+// Close the store of the chain
+func (chain *BlockChain) Close() error {
+	return chain.Store.Close()
 }
 
 // Add a new block into the chain
-func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
+func (chain *BlockChain) MineBlock(transactions []*Transaction) (*Block, error) {
+	block, _, err := chain.MineBlockContext(context.Background(), transactions, 0)
+	return block, err
+}
+
+// Mine a block on top of the tip with the workers, the mining stops with the
+// error of the context when it is done before a block is found. The proof of
+// work counts the hashes the block took.
+func (chain *BlockChain) MineBlockContext(ctx context.Context, transactions []*Transaction, workers int) (*Block, *ProofOfWork, error) {
 	var lastHash []byte
-	var lastHeight int
+	var lastBlock *Block
 
-	for _, tx := range transactions {
-		if !chain.VerifyTransaction(tx) {
-			log.Panic("Invalid Transaction")
+	err := chain.Store.View(func(txn StoreTxn) error {
+		var err error
+		if lastHash, err = txn.GetTip(); err != nil {
+			return err
 		}
+
+		lastBlock, err = txn.GetBlock(lastHash)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
 	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
+	// check the transactions before the work is spent, in their order so a
+	// transaction can spend the outputs of a previous one
+	height := lastBlock.Height + 1
+	view := NewUTXOView(&UTXOSet{chain})
+	for _, tx := range transactions {
+		if err := CheckTransactionSanity(tx, chain.Params.MaxMoney()); err != nil {
+			return nil, nil, err
 		}
-		lastHash, err = item.ValueCopy(lastHash)
-		if err != nil {
-			return err
+		if !tx.IsCoinbase() {
+			if _, err := CheckTransactionInputs(tx, view, height, chain.Params.CoinbaseMaturity); err != nil {
+				return nil, nil, err
+			}
 		}
-
-		item, err = txn.Get(lastHash)
-		if err != nil {
-			return err
+		if _, err := view.ConnectTransaction(tx, height); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		var lastBlockData []byte
-		lastBlockData, err = item.ValueCopy(lastBlockData)
-
-		lastBlock := Deserialize(lastBlockData)
-		lastHeight = lastBlock.Height
-
-		return err
-	})
-
-	ErrorHandler(err)
+	difficulty, err := chain.NextDifficulty(&lastBlock.BlockHeader)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// create a new block with the last hash
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
+	newBlock := NewBlock(transactions, lastHash, height, difficulty)
+	if size := len(newBlock.Serialize()); size > MaxBlockSize {
+		return nil, nil, ruleError(ErrBlockTooBig, "block of %d bytes, the maximum is %d", size, MaxBlockSize)
+	}
+
+	pow, err := newBlock.Mine(ctx, workers)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		ErrorHandler(err)
+	if err := chain.AddBlock(newBlock); err != nil {
+		return nil, nil, err
+	}
 
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	return newBlock, pow, nil
+}
 
-		chain.LastHash = newBlock.Hash
+// Add a block to the chain, the block is stored only once every consensus
+// rule passed on it. It becomes the tip when its branch holds more work than
+// the main chain, the UTXO set follows the tip into the same DB transaction.
+func (chain *BlockChain) AddBlock(block *Block) error {
+	chain.lock.Lock()
+	sw, err := chain.addBlock(block)
+	chain.lock.Unlock()
 
+	if err != nil {
 		return err
-	})
+	}
 
-	ErrorHandler(err)
+	if sw != nil {
+		chain.notifySwitch(sw)
+	}
 
-	return newBlock
+	return nil
 }
 
-func (chain *BlockChain) AddBlock(block *Block) {
-	err := chain.Database.Update(func(txn *badger.Txn) error {
+func (chain *BlockChain) addBlock(block *Block) (*chainSwitch, error) {
+	sw, work, err := chain.validateBlock(block)
+	if err != nil {
+		return nil, err
+	}
 
-		if _, err := txn.Get(block.Hash); err != nil {
-			return nil
+	err = chain.Store.Update(func(txn StoreTxn) error {
+		if err := txn.PutBlock(block); err != nil {
+			return err
 		}
 
-		blockData := block.Serialize()
-		err := txn.Set(block.Hash, blockData)
-		if err != nil {
+		if err := txn.PutWork(block.Hash, work); err != nil {
 			return err
 		}
 
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
+		if sw == nil {
+			return nil
 		}
 
-		var lastHash []byte
-		lastHash, err = item.ValueCopy(lastHash)
-		if err != nil {
-			return err
+		// move the indexes onto the new branch
+		for _, detached := range sw.detach {
+			if err := txn.DeleteHeight(detached.Height); err != nil {
+				return err
+			}
+			if chain.txIndex {
+				if err := unindexBlockTransactions(txn, detached); err != nil {
+					return err
+				}
+			}
+			if chain.addrIndex {
+				if err := unindexBlockAddresses(txn, detached); err != nil {
+					return err
+				}
+			}
 		}
 
-		item, err = txn.Get(lastHash)
-		if err != nil {
-			return err
+		// the undo data of every block joining the main chain
+		for i, attached := range sw.attach {
+			if err := txn.PutHeight(attached.Height, attached.Hash); err != nil {
+				return err
+			}
+			if err := txn.PutUndo(attached.Hash, sw.undo[i]); err != nil {
+				return err
+			}
+			if chain.txIndex {
+				if err := indexBlockTransactions(txn, attached); err != nil {
+					return err
+				}
+			}
+			if chain.addrIndex {
+				if err := indexBlockAddresses(txn, attached, sw.undo[i]); err != nil {
+					return err
+				}
+			}
 		}
 
-		var lastBlockData []byte
-		lastBlockData, err = item.ValueCopy(lastBlockData)
-		if err != nil {
+		UTXOSet := UTXOSet{chain}
+		if err := UTXOSet.writeView(txn, sw.view); err != nil {
 			return err
 		}
 
-		lastBlock := Deserialize(lastBlockData)
+		return txn.SetTip(block.Hash)
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			if err != nil {
-				return err
-			}
-			chain.LastHash = block.Hash
-		}
+	if sw != nil {
+		chain.tipLock.Lock()
+		chain.LastHash = block.Hash
+		chain.tipLock.Unlock()
+	}
 
-		return nil
+	return sw, nil
+}
+
+// Get the hash of the tip, safe while blocks are added
+func (chain *BlockChain) GetLastHash() []byte {
+	chain.tipLock.RLock()
+	defer chain.tipLock.RUnlock()
+
+	return chain.LastHash
+}
+
+// Check if the block is already stored
+func (chain *BlockChain) HasBlock(blockHash []byte) bool {
+	found := false
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		found, err = txn.HasBlock(blockHash)
+		return err
 	})
-	ErrorHandler(err)
+	return err == nil && found
 }
 
 // Get a block into the chain by the hash value
@@ -242,18 +362,12 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
 	// open read only into the DB
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		if item, err := txn.Get(blockHash); err != nil {
-			return errors.New("Block is not found")
-		} else {
-			var blockdata []byte
-			blockdata, err = item.ValueCopy(blockdata)
-			if err != nil {
-				return err
-			}
-			block = *Deserialize(blockdata)
+	err := chain.Store.View(func(txn StoreTxn) error {
+		decoded, err := txn.GetBlock(blockHash)
+		if err != nil {
+			return err
 		}
-
+		block = *decoded
 		return nil
 	})
 	if err != nil {
@@ -264,13 +378,16 @@ func (chain *BlockChain) GetBlock(blockHash []byte) (Block, error) {
 }
 
 // Get the map with hashes linked to block into the chain
-func (chain *BlockChain) GetBlockHashes() [][]byte {
+func (chain *BlockChain) GetBlockHashes() ([][]byte, error) {
 	var blocks [][]byte
 
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		blocks = append(blocks, block.Hash)
 
@@ -280,44 +397,24 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 		}
 	}
 
-	return blocks
+	return blocks, nil
 }
 
 // Get the max height index of block into the chain
-func (chain *BlockChain) GetBestHeight() int {
-	var lastBlock Block
-
-	// open read only into the DB
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		if err != nil {
-			return err
-		}
-
-		var lastHash []byte
-		lastHash, err = item.ValueCopy(lastHash)
-		if err != nil {
-			return err
-		}
-
-		item, err = txn.Get(lastHash)
-		if err != nil {
-			return err
-		}
-
-		var lastBlockData []byte
-		lastBlockData, err = item.ValueCopy(lastBlockData)
-		lastBlock = *Deserialize(lastBlockData)
+func (chain *BlockChain) GetBestHeight() (int, error) {
+	height := 0
 
+	// open read only into the DB and read the last height of the index
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		height, err = txn.BestHeight()
 		return err
 	})
-	ErrorHandler(err)
 
-	return lastBlock.Height
+	return height, err
 }
 
 // Retreive all the output transactions
-func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
+func (chain *BlockChain) FindUTXO() (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 
 	spentTXOs := make(map[string][]int)
@@ -325,7 +422,10 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -340,13 +440,15 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 					}
 				}
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs.Height = block.Height
+				outs.Coinbase = tx.IsCoinbase()
+				outs.Add(outIdx, out)
 				UTXO[txID] = outs
 			}
 			if !tx.IsCoinbase() {
 				for _, in := range tx.Inputs {
 					inTxID := hex.EncodeToString(in.ID)
-					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Index())
 				}
 			}
 		}
@@ -355,19 +457,43 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 			break
 		}
 	}
-	return UTXO
+	return UTXO, nil
 }
 
 // Search a transaction into the chain by the ID
 func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := chain.findTransaction(ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return *tx, nil
+}
+
+// Search a transaction and its block into the main chain, through the
+// transaction index when the chain keeps it
+func (chain *BlockChain) findTransaction(ID []byte) (*Transaction, *Block, error) {
+	if chain.txIndex {
+		tx, block, err := chain.findIndexedTransaction(ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tx == nil {
+			return nil, nil, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+		}
+		return tx, block, nil
+	}
+
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Equal(tx.ID, ID) {
-				return *tx, nil
+				return tx, block, nil
 			}
 		}
 
@@ -377,35 +503,66 @@ func (chain *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction doesn't exist")
+	return nil, nil, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
 }
 
 // Function to sign a transaction into the chain
-func (chain *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+func (chain *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTX, err := chain.FindTransaction(in.ID)
-		ErrorHandler(err)
+		if err != nil {
+			return err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return tx.Sign(privKey, prevTXs)
 }
 
 // Function to verify a transaction into the chain
-func (chain *BlockChain) VerifyTransaction(tx *Transaction) bool {
+func (chain *BlockChain) VerifyTransaction(tx *Transaction) (bool, error) {
 	if tx.IsCoinbase() {
-		return true
+		return true, nil
 	}
 
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTX, err := chain.FindTransaction(in.ID)
-		ErrorHandler(err)
+		if err != nil {
+			return false, err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	return tx.Verify(prevTXs)
+	return tx.Verify(prevTXs), nil
+}
+
+// Get the fee of a transaction, the value of the outputs it spends minus the
+// value of its outputs
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	fee := 0
+
+	for _, in := range tx.Inputs {
+		prevTX, err := chain.FindTransaction(in.ID)
+		if err != nil {
+			return 0, err
+		}
+		if in.Index() >= len(prevTX.Outputs) {
+			return 0, fmt.Errorf("%w: %x has no output %d", ErrInvalidTx, in.ID, in.Index())
+		}
+		fee += prevTX.Outputs[in.Index()].Value
+	}
+
+	for _, out := range tx.Outputs {
+		fee -= out.Value
+	}
+
+	return fee, nil
 }
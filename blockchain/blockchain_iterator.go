@@ -1,37 +1,55 @@
 package blockchain
 
-import "github.com/dgraph-io/badger"
+import "errors"
 
 type BlockChainIterator struct {
 	CurrentHash []byte
-	Database    *badger.DB
+	Store       ChainStore
 }
 
 // Convert the blockchain into iterator
 func (chain *BlockChain) Iterator() *BlockChainIterator {
-	iter := &BlockChainIterator{chain.LastHash, chain.Database}
+	iter := &BlockChainIterator{chain.GetLastHash(), chain.Store}
 	return iter
 }
 
 // Move to the next element into the chain
-func (iter *BlockChainIterator) Next() *Block {
+func (iter *BlockChainIterator) Next() (*Block, error) {
 	var block *Block
 
-	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		ErrorHandler(err)
-
-		err = item.Value(func(encodedBlock []byte) error {
-			block = Deserialize(encodedBlock)
-			return nil
-		})
-
+	err := iter.Store.View(func(txn StoreTxn) (err error) {
+		block, err = txn.GetBlock(iter.CurrentHash)
 		return err
 	})
-
-	ErrorHandler(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iter.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
+}
+
+type BlockChainForwardIterator struct {
+	Height int
+	chain  *BlockChain
+}
+
+// Convert the main chain into iterator starting at the genesis block
+func (chain *BlockChain) ForwardIterator() *BlockChainForwardIterator {
+	return &BlockChainForwardIterator{0, chain}
+}
+
+// Move to the next element into the main chain, nil once past the tip
+func (iter *BlockChainForwardIterator) Next() (*Block, error) {
+	block, err := iter.chain.GetBlockByHeight(iter.Height)
+	if errors.Is(err, ErrHeightNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	iter.Height++
+
+	return &block, nil
 }
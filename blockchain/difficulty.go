@@ -0,0 +1,69 @@
+package blockchain
+
+// max number of bits the difficulty can move on one adjustment
+const maxRetargetStep = 2
+
+// Compute the difficulty a block mined on top of prev must claim, the window
+// is read from the headers so a header is checked before its body comes
+func (chain *BlockChain) NextDifficulty(prev *BlockHeader) (int, error) {
+	height := prev.Height + 1
+	interval := chain.Params.RetargetInterval
+
+	// keep the same difficulty between two adjustments
+	if interval == 0 || height%interval != 0 {
+		return prev.Bits, nil
+	}
+
+	// walk back to the first block of the window which ends with prev
+	first := prev
+	for i := 0; i < interval-1; i++ {
+		header, err := chain.GetHeader(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		first = &header
+	}
+
+	actual := prev.Timestamp - first.Timestamp
+	expected := chain.Params.TargetBlockTime * int64(interval-1)
+
+	difficulty := Retarget(prev.Bits, actual, expected)
+	if difficulty < chain.Params.MinDifficulty {
+		difficulty = chain.Params.MinDifficulty
+	}
+
+	return difficulty, nil
+}
+
+// Adjust the difficulty from the actual and the expected timespan of a window.
+// Every halving of the timespan adds one bit, every doubling removes one bit.
+func Retarget(difficulty int, actual, expected int64) int {
+	if actual < 1 {
+		actual = 1
+	}
+
+	step := 0
+
+	// the blocks came too fast, ask for more zero bits
+	for step < maxRetargetStep && actual*2 <= expected {
+		actual *= 2
+		step++
+	}
+
+	// the blocks came too slow, ask for less zero bits
+	for step > -maxRetargetStep && actual >= expected*2 {
+		expected *= 2
+		step--
+	}
+
+	difficulty += step
+
+	if difficulty < MinDifficulty {
+		difficulty = MinDifficulty
+	}
+	if difficulty > MaxDifficulty {
+		difficulty = MaxDifficulty
+	}
+
+	return difficulty
+}
@@ -0,0 +1,20 @@
+package blockchain
+
+import "errors"
+
+// Errors returned by the chain, check them with errors.Is
+var (
+	ErrChainExists    = errors.New("Blockchain already exists")
+	ErrChainNotFound  = errors.New("No existing Blockchain found")
+	ErrBlockNotFound  = errors.New("Block is not found")
+	ErrTxNotFound     = errors.New("Transaction doesn't exist")
+	ErrHeightNotFound = errors.New("No block at this height into the main chain")
+	ErrPrevTxNotFound = errors.New("Previous transaction doesn't exist")
+	ErrOutputNotFound = errors.New("Output is not into the UTXO set")
+	ErrNotEnoughFunds = errors.New("Not enough funds for this transaction")
+	ErrInvalidTx      = errors.New("Invalid transaction")
+	ErrDecode         = errors.New("Data can't be decoded")
+	ErrNoAddrIndex    = errors.New("The address index is not enabled")
+	ErrBadUndo        = errors.New("Undo data doesn't match the block")
+	ErrBadTxProof     = errors.New("Transaction proof is not valid")
+)
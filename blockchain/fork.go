@@ -0,0 +1,140 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// Blocks to move the tip of the chain onto another branch, and the unspent
+// outputs as they are once moved
+type chainSwitch struct {
+	// blocks leaving the main chain, from the current tip
+	detach []*Block
+	// blocks joining the main chain, from the fork point
+	attach []*Block
+	// undo data of the attached blocks
+	undo []*BlockUndo
+	view *UTXOView
+}
+
+// Expected number of hashes to mine a block at the difficulty
+func BlockWork(difficulty int) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+// Get the cumulative proof-of-work of the chain ending with the block
+func (chain *BlockChain) GetChainWork(blockHash []byte) (*big.Int, error) {
+	var blocks []*Block
+	work := big.NewInt(0)
+
+	// walk back to the first block with a stored work, the blocks stored
+	// before the work was recorded are summed from the genesis
+	for hash := blockHash; ; {
+		stored, err := chain.storedWork(hash)
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			work = stored
+			break
+		}
+
+		block, err := chain.GetBlock(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, &block)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+		hash = block.PrevHash
+	}
+
+	for _, block := range blocks {
+		work.Add(work, BlockWork(block.Bits))
+	}
+
+	return work, nil
+}
+
+// Get the work recorded for the block, nil when it is not recorded
+func (chain *BlockChain) storedWork(blockHash []byte) (*big.Int, error) {
+	var work *big.Int
+
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		work, err = txn.GetWork(blockHash)
+		return err
+	})
+
+	return work, err
+}
+
+// Plan the move of the tip to the target block, the view of the plan holds
+// the outputs unspent once the target is the tip
+func (chain *BlockChain) switchTo(target *Block) (*chainSwitch, error) {
+	sw := &chainSwitch{view: NewUTXOView(&UTXOSet{chain})}
+
+	tip, err := chain.GetBlock(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
+
+	main, side := &tip, target
+
+	parent := func(block *Block) (*Block, error) {
+		prev, err := chain.GetBlock(block.PrevHash)
+		return &prev, err
+	}
+
+	// walk back both branches until they meet at the fork point
+	for !bytes.Equal(main.Hash, side.Hash) {
+		if main.Height >= side.Height {
+			sw.detach = append(sw.detach, main)
+			if main, err = parent(main); err != nil {
+				return nil, err
+			}
+		} else {
+			sw.attach = append([]*Block{side}, sw.attach...)
+			if side, err = parent(side); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, block := range sw.detach {
+		undo, err := chain.GetBlockUndo(block)
+		if err != nil {
+			return nil, err
+		}
+		if err := sw.view.DisconnectBlock(block, undo); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, block := range sw.attach {
+		undo, err := chain.checkBlockTransactions(block, sw.view)
+		if err != nil {
+			return nil, err
+		}
+		sw.undo = append(sw.undo, undo)
+	}
+
+	return sw, nil
+}
+
+// Get the output spent by an input of the main chain, only used for the
+// blocks stored without undo data
+func (chain *BlockChain) spentOutput(in TxInput) (SpentOutput, error) {
+	tx, block, err := chain.findTransaction(in.ID)
+	if err != nil {
+		return SpentOutput{}, err
+	}
+
+	if in.Index() >= len(tx.Outputs) {
+		return SpentOutput{}, fmt.Errorf("Transaction %x has no output %d", in.ID, in.Index())
+	}
+
+	return SpentOutput{tx.Outputs[in.Index()], block.Height, tx.IsCoinbase()}, nil
+}
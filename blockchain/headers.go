@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Max number of headers sent into one message
+const MaxHeadersPerMessage = 2000
+
+// Max number of items of an inventory, the following ones are claimed after
+// the last one
+const MaxInvPerMessage = 2000
+
+// Get the header of a block stored into the chain, the header can be stored
+// without its body
+func (chain *BlockChain) GetHeader(hash []byte) (BlockHeader, error) {
+	var header BlockHeader
+
+	err := chain.Store.View(func(txn StoreTxn) error {
+		decoded, err := txn.GetHeader(hash)
+		if err != nil {
+			return err
+		}
+		if decoded == nil {
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+		}
+		header = *decoded
+		return nil
+	})
+
+	return header, err
+}
+
+// Store a header received before its body, the header must extend a known
+// header with a valid proof of work at the difficulty of the schedule. The
+// body is validated when it comes.
+func (chain *BlockChain) AddHeader(header *BlockHeader) error {
+	hash := header.ComputeHash()
+
+	if !NewHeaderProof(header).Validate() {
+		return ruleError(ErrBadProofOfWork, "header %x with difficulty %d", hash, header.Bits)
+	}
+
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return ruleError(ErrBadTimestamp, "header %x is too far in the future", hash)
+	}
+
+	parent, err := chain.GetHeader(header.PrevHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return ruleError(ErrMissingParent, "header %x has the parent %x", hash, header.PrevHash)
+	} else if err != nil {
+		return err
+	}
+
+	if err := chain.checkHeaderContext(header, hash, &parent); err != nil {
+		return err
+	}
+
+	return chain.Store.Update(func(txn StoreTxn) error {
+		known, err := txn.GetHeader(hash)
+		if err != nil || known != nil {
+			return err
+		}
+
+		return txn.PutHeader(hash, header)
+	})
+}
+
+// Get the headers of the main chain following the block, from the genesis
+// when the block isn't on the main chain
+func (chain *BlockChain) GetHeadersAfter(hash []byte, max int) ([]BlockHeader, error) {
+	var headers []BlockHeader
+
+	err := chain.Store.View(func(txn StoreTxn) error {
+		hashes, err := mainHashesAfter(txn, hash, max)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			header, err := txn.GetHeader(hash)
+			if err != nil {
+				return err
+			}
+			if header == nil {
+				return fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+			}
+			headers = append(headers, *header)
+		}
+
+		return nil
+	})
+
+	return headers, err
+}
+
+// Get the hashes of the main chain following the block, from the oldest one
+// and from the genesis when the block isn't on the main chain
+func (chain *BlockChain) GetBlockHashesAfter(hash []byte, max int) ([][]byte, error) {
+	var hashes [][]byte
+
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		hashes, err = mainHashesAfter(txn, hash, max)
+		return err
+	})
+
+	return hashes, err
+}
+
+// Hashes of the height index following the block, at most max of them
+func mainHashesAfter(txn StoreTxn, hash []byte, max int) ([][]byte, error) {
+	start := 0
+
+	header, err := txn.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		mainHash, err := txn.GetHashByHeight(header.Height)
+		if err == nil && bytes.Equal(mainHash, hash) {
+			start = header.Height + 1
+		}
+	}
+
+	best, err := txn.BestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	for height := start; height <= best && len(hashes) < max; height++ {
+		hash, err := txn.GetHashByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
@@ -0,0 +1,70 @@
+package blockchain
+
+import "fmt"
+
+// Get the hash of the main chain block at the height
+func (chain *BlockChain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+
+	if height < 0 {
+		return nil, fmt.Errorf("%w: %d", ErrHeightNotFound, height)
+	}
+
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		hash, err = txn.GetHashByHeight(height)
+		return err
+	})
+
+	return hash, err
+}
+
+// Get the main chain block at the height
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+	return chain.GetBlock(hash)
+}
+
+// Get the main chain blocks from the height from to the height to, both included
+func (chain *BlockChain) GetBlockRange(from, to int) ([]Block, error) {
+	if from > to {
+		return nil, fmt.Errorf("Invalid range of heights %d to %d", from, to)
+	}
+
+	blocks := make([]Block, 0, to-from+1)
+
+	for height := from; height <= to; height++ {
+		block, err := chain.GetBlockByHeight(height)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// Index the main chain from the tip, for the chains stored before the index
+func (chain *BlockChain) buildHeightIndex() error {
+	hash := chain.LastHash
+
+	return chain.Store.Update(func(txn StoreTxn) error {
+		for {
+			block, err := txn.GetBlock(hash)
+			if err != nil {
+				return err
+			}
+
+			if err := txn.PutHeight(block.Height, block.Hash); err != nil {
+				return err
+			}
+
+			if len(block.PrevHash) == 0 {
+				return nil
+			}
+			hash = block.PrevHash
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var errReadOnlyTxn = errors.New("Change into a read only transaction")
+
+// ChainStore kept in memory, for the tests and the simulations. The values
+// are stored serialized so the callers never share them with the store.
+type MemoryStore struct {
+	lock sync.RWMutex
+
+	headers   map[string][]byte
+	bodies    map[string][]byte
+	tip       []byte
+	work      map[string][]byte
+	undo      map[string][]byte
+	heights   map[string][]byte
+	utxo      map[string][]byte
+	txIndex   map[string][]byte
+	addrIndex map[string][]byte
+	flags     map[string][]byte
+
+	// highest height of the height index, -1 when it is empty
+	best int
+}
+
+type memoryTxn struct {
+	store    *MemoryStore
+	writable bool
+	// reverts the changes of the transaction, from the last one
+	journal []func()
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		headers:   make(map[string][]byte),
+		bodies:    make(map[string][]byte),
+		work:      make(map[string][]byte),
+		undo:      make(map[string][]byte),
+		heights:   make(map[string][]byte),
+		utxo:      make(map[string][]byte),
+		txIndex:   make(map[string][]byte),
+		addrIndex: make(map[string][]byte),
+		flags:     make(map[string][]byte),
+
+		best: -1,
+	}
+}
+
+func (s *MemoryStore) View(fn func(txn StoreTxn) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return fn(&memoryTxn{store: s})
+}
+
+func (s *MemoryStore) Update(fn func(txn StoreTxn) error) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	txn := &memoryTxn{store: s, writable: true}
+	if err := fn(txn); err != nil {
+		for i := len(txn.journal) - 1; i >= 0; i-- {
+			txn.journal[i]()
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Set the value of the key into the map, a nil value deletes the key
+func (t *memoryTxn) set(m map[string][]byte, key []byte, value []byte) error {
+	if !t.writable {
+		return errReadOnlyTxn
+	}
+
+	k := string(key)
+	old, found := m[k]
+	t.journal = append(t.journal, func() {
+		if found {
+			m[k] = old
+		} else {
+			delete(m, k)
+		}
+	})
+
+	if value == nil {
+		delete(m, k)
+	} else {
+		m[k] = append([]byte{}, value...)
+	}
+
+	return nil
+}
+
+// Call fn on the values of the keys starting by the prefix, sorted by key
+func forEachSorted(m map[string][]byte, prefix string, fn func(key string, value []byte) error) error {
+	var keys []string
+	for key := range m {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := fn(key, m[key]); err == ErrStopIteration {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTxn) GetBlock(hash []byte) (*Block, error) {
+	header, err := t.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := t.store.bodies[string(hash)]
+	if header == nil || !ok {
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	}
+
+	txs, err := deserializeBody(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Block{*header, append([]byte{}, hash...), txs}, nil
+}
+
+func (t *memoryTxn) HasBlock(hash []byte) (bool, error) {
+	_, ok := t.store.bodies[string(hash)]
+	return ok, nil
+}
+
+func (t *memoryTxn) PutBlock(block *Block) error {
+	if err := t.PutHeader(block.Hash, &block.BlockHeader); err != nil {
+		return err
+	}
+	return t.set(t.store.bodies, block.Hash, serializeBody(block.Transactions))
+}
+
+func (t *memoryTxn) GetHeader(hash []byte) (*BlockHeader, error) {
+	data, ok := t.store.headers[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	return DeserializeHeader(data)
+}
+
+func (t *memoryTxn) PutHeader(hash []byte, header *BlockHeader) error {
+	return t.set(t.store.headers, hash, header.Serialize())
+}
+
+func (t *memoryTxn) GetTip() ([]byte, error) {
+	if t.store.tip == nil {
+		return nil, ErrChainNotFound
+	}
+	return append([]byte{}, t.store.tip...), nil
+}
+
+func (t *memoryTxn) SetTip(hash []byte) error {
+	if !t.writable {
+		return errReadOnlyTxn
+	}
+
+	old := t.store.tip
+	t.journal = append(t.journal, func() { t.store.tip = old })
+	t.store.tip = append([]byte{}, hash...)
+
+	return nil
+}
+
+func (t *memoryTxn) GetWork(hash []byte) (*big.Int, error) {
+	data, ok := t.store.work[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (t *memoryTxn) PutWork(hash []byte, work *big.Int) error {
+	return t.set(t.store.work, hash, work.Bytes())
+}
+
+func (t *memoryTxn) GetUndo(hash []byte) (*BlockUndo, error) {
+	data, ok := t.store.undo[string(hash)]
+	if !ok {
+		return nil, nil
+	}
+	return DeserializeUndo(data)
+}
+
+func (t *memoryTxn) PutUndo(hash []byte, undo *BlockUndo) error {
+	return t.set(t.store.undo, hash, undo.Serialize())
+}
+
+func (t *memoryTxn) GetHashByHeight(height int) ([]byte, error) {
+	hash, ok := t.store.heights[string(heightKey(height))]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrHeightNotFound, height)
+	}
+	return append([]byte{}, hash...), nil
+}
+
+func (t *memoryTxn) PutHeight(height int, hash []byte) error {
+	if err := t.set(t.store.heights, heightKey(height), hash); err != nil {
+		return err
+	}
+	if height > t.store.best {
+		t.setBest(height)
+	}
+	return nil
+}
+
+func (t *memoryTxn) DeleteHeight(height int) error {
+	if err := t.set(t.store.heights, heightKey(height), nil); err != nil {
+		return err
+	}
+	if height != t.store.best {
+		return nil
+	}
+
+	// the heights are deleted from the tip, the next one is right below
+	best := height - 1
+	for best >= 0 {
+		if _, ok := t.store.heights[string(heightKey(best))]; ok {
+			break
+		}
+		best--
+	}
+	t.setBest(best)
+	return nil
+}
+
+func (t *memoryTxn) setBest(height int) {
+	old := t.store.best
+	t.journal = append(t.journal, func() { t.store.best = old })
+	t.store.best = height
+}
+
+func (t *memoryTxn) BestHeight() (int, error) {
+	if t.store.best < 0 {
+		return 0, ErrHeightNotFound
+	}
+	return t.store.best, nil
+}
+
+func (t *memoryTxn) GetOutputs(txID []byte) (TxOutputs, bool, error) {
+	data, ok := t.store.utxo[string(txID)]
+	if !ok {
+		return TxOutputs{}, false, nil
+	}
+	outs, err := DeserializeOutputs(data)
+	return outs, err == nil, err
+}
+
+func (t *memoryTxn) PutOutputs(txID []byte, outs TxOutputs) error {
+	return t.set(t.store.utxo, txID, outs.Serialize())
+}
+
+func (t *memoryTxn) DeleteOutputs(txID []byte) error {
+	return t.set(t.store.utxo, txID, nil)
+}
+
+func (t *memoryTxn) ForEachOutputs(fn func(txID []byte, outs TxOutputs) error) error {
+	return forEachSorted(t.store.utxo, "", func(key string, value []byte) error {
+		outs, err := DeserializeOutputs(value)
+		if err != nil {
+			return err
+		}
+		return fn([]byte(key), outs)
+	})
+}
+
+func (t *memoryTxn) ClearOutputs() error {
+	for key := range t.store.utxo {
+		if err := t.set(t.store.utxo, []byte(key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTxn) GetTxLocation(txID []byte) (*TxLocation, error) {
+	data, ok := t.store.txIndex[string(txID)]
+	if !ok {
+		return nil, nil
+	}
+	loc, err := DeserializeTxLocation(data)
+	if err != nil {
+		return nil, err
+	}
+	return &loc, nil
+}
+
+func (t *memoryTxn) PutTxLocation(txID []byte, loc TxLocation) error {
+	return t.set(t.store.txIndex, txID, loc.Serialize())
+}
+
+func (t *memoryTxn) DeleteTxLocation(txID []byte) error {
+	return t.set(t.store.txIndex, txID, nil)
+}
+
+func (t *memoryTxn) PutAddrEvent(pubKeyHash []byte, height, position int, event AddrEvent) error {
+	return t.set(t.store.addrIndex, addrIndexKey(pubKeyHash, height, position), event.Serialize())
+}
+
+func (t *memoryTxn) DeleteAddrEvent(pubKeyHash []byte, height, position int) error {
+	return t.set(t.store.addrIndex, addrIndexKey(pubKeyHash, height, position), nil)
+}
+
+func (t *memoryTxn) ForEachAddrEvent(pubKeyHash []byte, fn func(event AddrEvent) error) error {
+	prefix := string(prefixedKey(addrIndexPrefix, pubKeyHash))
+
+	return forEachSorted(t.store.addrIndex, prefix, func(key string, value []byte) error {
+		// the keys of a longer public key hash share the prefix
+		if len(key) != len(prefix)+12 {
+			return nil
+		}
+
+		event, err := DeserializeAddrEvent(value)
+		if err != nil {
+			return err
+		}
+		return fn(event)
+	})
+}
+
+func (t *memoryTxn) HasFlag(name string) (bool, error) {
+	_, ok := t.store.flags[name]
+	return ok, nil
+}
+
+func (t *memoryTxn) SetFlag(name string) error {
+	return t.set(t.store.flags, []byte(name), []byte{1})
+}
@@ -1,9 +1,18 @@
 package blockchain
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
 
+// Merkle tree of the transactions of a block. The last node of a level with
+// an odd count is carried up as it is, it is never paired with a copy of
+// itself, so two lists of leaves can't give the same root that way.
 type MerkleTree struct {
 	RootNode *MerkleNode
+	// nodes of every level, from the leaves to the root
+	levels [][]*MerkleNode
 }
 
 type MerkleNode struct {
@@ -20,7 +29,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 		hash := sha256.Sum256(data)
 		node.Data = hash[:]
 	} else {
-		prevHashes := append(left.Data, right.Data...)
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
 		hash := sha256.Sum256(prevHashes)
 		node.Data = hash[:]
 	}
@@ -31,33 +40,112 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
-// create a new tree and return the reference into it
+// create a new tree and return the reference into it, the root of a tree
+// without leaves holds no data
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
-
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	if len(data) == 0 {
+		return &MerkleTree{RootNode: &MerkleNode{}}
 	}
 
-	for _, value := range data {
-		// create level N-1 of the root node
-		node := NewMerkleNode(nil, nil, value)
-		nodes = append(nodes, *node)
+	nodes := make([]*MerkleNode, len(data))
+	for i, value := range data {
+		nodes[i] = NewMerkleNode(nil, nil, value)
 	}
 
-	for i := 0; i < len(data)/2; i++ {
-		var level []MerkleNode
+	levels := [][]*MerkleNode{nodes}
+
+	for len(nodes) > 1 {
+		level := make([]*MerkleNode, 0, (len(nodes)+1)/2)
+
+		for j := 0; j+1 < len(nodes); j += 2 {
+			level = append(level, NewMerkleNode(nodes[j], nodes[j+1], nil))
+		}
 
-		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			level = append(level, *node)
+		// the odd node goes up alone
+		if len(nodes)%2 != 0 {
+			level = append(level, nodes[len(nodes)-1])
 		}
 
+		levels = append(levels, level)
 		nodes = level
 	}
 
-	// build the tree with the root node
-	tree := MerkleTree{&nodes[0]}
+	return &MerkleTree{nodes[0], levels}
+}
+
+// Path from a leaf to the root, the hashes of the siblings from the leaf up.
+// The levels where the node is carried up have no sibling, they are found
+// from the number of leaves.
+type MerkleProof struct {
+	Index  int
+	Leaves int
+	Hashes [][]byte
+}
+
+// Build the proof of the leaf at the index
+func (t *MerkleTree) Proof(index int) (MerkleProof, error) {
+	leaves := 0
+	if len(t.levels) > 0 {
+		leaves = len(t.levels[0])
+	}
+
+	if index < 0 || index >= leaves {
+		return MerkleProof{}, fmt.Errorf("Leaf %d is out of the tree of %d leaves", index, leaves)
+	}
+
+	proof := MerkleProof{Index: index, Leaves: leaves}
+
+	position := index
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := position ^ 1
+		if sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling].Data)
+		}
+		position /= 2
+	}
+
+	return proof, nil
+}
+
+// Check that the leaf of the proof is the transaction into the tree of the
+// root, the leaves of a block are the IDs of its transactions. The leaves and
+// the siblings are hashes, a longer leaf could be the two children of an inner
+// node and pass for a leaf higher in the tree.
+func VerifyMerkleProof(root, txHash []byte, proof MerkleProof) bool {
+	if proof.Index < 0 || proof.Index >= proof.Leaves {
+		return false
+	}
+	if len(txHash) != sha256.Size {
+		return false
+	}
+	for _, sibling := range proof.Hashes {
+		if len(sibling) != sha256.Size {
+			return false
+		}
+	}
+
+	hash := sha256.Sum256(txHash)
+	position := proof.Index
+	hashes := proof.Hashes
+
+	for count := proof.Leaves; count > 1; count = (count + 1) / 2 {
+		sibling := position ^ 1
+
+		if sibling < count {
+			if len(hashes) == 0 {
+				return false
+			}
+
+			if position%2 == 0 {
+				hash = sha256.Sum256(append(hash[:], hashes[0]...))
+			} else {
+				hash = sha256.Sum256(append(append([]byte{}, hashes[0]...), hash[:]...))
+			}
+			hashes = hashes[1:]
+		}
+
+		position /= 2
+	}
 
-	return &tree
+	return len(hashes) == 0 && bytes.Equal(hash[:], root)
 }
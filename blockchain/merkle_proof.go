@@ -0,0 +1,97 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Proof that a transaction sits into a block, it is checked with the header
+// alone so a light client doesn't need the body
+type TxProof struct {
+	TxID   []byte
+	Header BlockHeader
+	Proof  MerkleProof
+}
+
+func (p *TxProof) Serialize() []byte {
+	return encode(p)
+}
+
+func DeserializeTxProof(data []byte) (*TxProof, error) {
+	var proof TxProof
+
+	if err := decode(data, &proof); err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
+
+// Get the hash of the block holding the transaction
+func (p *TxProof) BlockHash() []byte {
+	return p.Header.ComputeHash()
+}
+
+// Check the proof of work of the header and the path from the transaction
+// to its Merkle root
+func (p *TxProof) Verify() bool {
+	return NewHeaderProof(&p.Header).Validate() && VerifyMerkleProof(p.Header.MerkleRoot, p.TxID, p.Proof)
+}
+
+// Check the proof and that its header is the one of the main chain at its
+// height, with the number of leaves of the block. The proof alone only shows
+// the work of the header at the difficulty it claims, anyone can forge one at
+// the lowest difficulty.
+func (chain *BlockChain) VerifyTxProof(p *TxProof) error {
+	if !p.Verify() {
+		return fmt.Errorf("%w: transaction %x", ErrBadTxProof, p.TxID)
+	}
+
+	hash, err := chain.GetBlockHashByHeight(p.Header.Height)
+	if errors.Is(err, ErrHeightNotFound) {
+		return fmt.Errorf("%w: block %x isn't into the main chain", ErrBadTxProof, p.BlockHash())
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, p.BlockHash()) {
+		return fmt.Errorf("%w: block %x isn't into the main chain", ErrBadTxProof, p.BlockHash())
+	}
+
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return err
+	}
+	if p.Proof.Leaves != len(block.Transactions) {
+		return fmt.Errorf("%w: %d leaves for the %d transactions of block %x", ErrBadTxProof, p.Proof.Leaves, len(block.Transactions), hash)
+	}
+
+	return nil
+}
+
+// Build the proof of a main chain transaction
+func (chain *BlockChain) GetTxProof(ID []byte) (*TxProof, error) {
+	_, block, err := chain.findTransaction(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var txHashes [][]byte
+	index := -1
+	for i, tx := range block.Transactions {
+		txHashes = append(txHashes, tx.ID)
+		if bytes.Equal(tx.ID, ID) {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+	}
+
+	proof, err := NewMerkleTree(txHashes).Proof(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TxProof{ID, block.BlockHeader, proof}, nil
+}
@@ -0,0 +1,173 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		leaves[i] = []byte(fmt.Sprintf("tx%d", i))
+	}
+	return leaves
+}
+
+// Root computed level by level on plain hashes, the odd hash goes up alone
+func referenceRoot(leaves [][]byte) []byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		hash := sha256.Sum256(leaf)
+		level[i] = hash[:]
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			hash := sha256.Sum256(append(append([]byte{}, level[i]...), level[i+1]...))
+			next = append(next, hash[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+func TestMerkleRootVectors(t *testing.T) {
+	vectors := []struct {
+		leaves int
+		root   string
+	}{
+		{1, "95cd603fe577fa9548ec0c9b50b067566fe07c8af6acba45f6196f3a15d511f6"},
+		{2, "9db4d4c69f3d7236f4de569987d746845d8d85250703351226c5a3cdaf1f66ea"},
+		{3, "720d8a7c24cd365e24ce1e5eb99410715bb1d17a906712ea8b8cbfe6e9726405"},
+		{4, "9db19fd4038d720fb19dec0f50cd6afbafe918851ddbb718773abff9783faeb0"},
+		{5, "069ebc1c02937f0a6d6157146496a5bcd068f5cb5795cf9b3cdac911374830de"},
+		{6, "e22e2a8ecc4ba4546c0a902eea086d31cf2c60bfff56c2de573eb78f66704762"},
+		{7, "8b68ccf5f69232eee363abf3f52da77449cfd5426267d03f9fbc774d7a64b24f"},
+		{8, "f63bbac3bede2bdfb434f707df2998789070e31706d1fe368eb998bcb4a02173"},
+		{9, "f6079d6a8f303660faafbb48f55c3177e756bfeea7e1d98bfde7dd672d9f25e1"},
+		{16, "04d7ee16b1d248d2a75a8df5d9c6bdc3bb8dd8d607b0d457eb656fd98166aded"},
+		{17, "494a599c95198446e2be32c9e4121cab8f75d52b11f2078b27fc040af03a4ca5"},
+		{31, "dc5fcbb859b627b6f949391d0d21cd89f4df78b803037f1c0b732747b8b7f7f6"},
+		{64, "58bcbbbd69ec392655ac9b3a27fe0ef540ea4390668a68e1661e0cc79afcb870"},
+		{100, "b1d6418c3598ca7fa856f4b2ba059d74b94551fcaff8e027be3a878e7624134b"},
+	}
+
+	for _, v := range vectors {
+		root := NewMerkleTree(testLeaves(v.leaves)).RootNode.Data
+		if got := hex.EncodeToString(root); got != v.root {
+			t.Errorf("%d leaves: root %s, expected %s", v.leaves, got, v.root)
+		}
+	}
+
+	for n := 1; n <= 100; n++ {
+		leaves := testLeaves(n)
+		root := NewMerkleTree(leaves).RootNode.Data
+		if expected := referenceRoot(leaves); !bytes.Equal(root, expected) {
+			t.Errorf("%d leaves: root %x, expected %x", n, root, expected)
+		}
+	}
+}
+
+func TestMerkleProofRoundTrip(t *testing.T) {
+	other := sha256.Sum256([]byte("other"))
+
+	for n := 1; n <= 100; n++ {
+		// the leaves of a proof are transaction IDs
+		leaves := testLeaves(n)
+		for i, leaf := range leaves {
+			hash := sha256.Sum256(leaf)
+			leaves[i] = hash[:]
+		}
+		tree := NewMerkleTree(leaves)
+		root := tree.RootNode.Data
+
+		for i := range leaves {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("%d leaves: proof of %d: %s", n, i, err)
+			}
+			if !VerifyMerkleProof(root, leaves[i], proof) {
+				t.Errorf("%d leaves: proof of %d doesn't verify", n, i)
+			}
+
+			// the proof is bound to its leaf and its position
+			if VerifyMerkleProof(root, other[:], proof) {
+				t.Errorf("%d leaves: proof of %d verifies another leaf", n, i)
+			}
+			if n > 1 {
+				moved := proof
+				moved.Index = (i + 1) % n
+				if VerifyMerkleProof(root, leaves[i], moved) {
+					t.Errorf("%d leaves: proof of %d verifies at %d", n, i, moved.Index)
+				}
+			}
+		}
+
+		if _, err := tree.Proof(n); err == nil {
+			t.Errorf("%d leaves: proof of a leaf out of the tree", n)
+		}
+	}
+}
+
+func TestDuplicatedLastLeafRejected(t *testing.T) {
+	coinbase := &Transaction{
+		Inputs:  []TxInput{{ID: []byte{}, Out: -1, Signature: heightCommitment(1)}},
+		Outputs: []TxOutput{{Value: 20, PubKeyHash: make([]byte, 20)}},
+	}
+	coinbase.ID = coinbase.Hash()
+
+	tx := &Transaction{
+		Inputs:  []TxInput{{ID: make([]byte, 32), Out: 0}},
+		Outputs: []TxOutput{{Value: 1, PubKeyHash: make([]byte, 20)}},
+	}
+	tx.ID = tx.Hash()
+
+	// the odd node isn't paired with its copy, the copy changes the root
+	root := NewMerkleTree([][]byte{coinbase.ID, tx.ID}).RootNode.Data
+	duplicated := NewMerkleTree([][]byte{coinbase.ID, tx.ID, tx.ID}).RootNode.Data
+	if bytes.Equal(root, duplicated) {
+		t.Fatal("duplicated last leaf gives the same root")
+	}
+
+	block := CreateBlock([]*Transaction{coinbase, tx, tx}, make([]byte, 32), 1, MinDifficulty)
+
+	err := CheckBlockSanity(block, RegTestParams.MaxMoney())
+	if !errors.Is(err, ErrDuplicateTx) {
+		t.Fatalf("expected %s, got %v", ErrDuplicateTx, err)
+	}
+}
+
+func TestMerkleProofForgedLeaf(t *testing.T) {
+	leaves := [][]byte{
+		bytes.Repeat([]byte{0}, 32),
+		bytes.Repeat([]byte{1}, 32),
+		bytes.Repeat([]byte{2}, 32),
+		bytes.Repeat([]byte{3}, 32),
+	}
+	tree := NewMerkleTree(leaves)
+	root := tree.RootNode.Data
+
+	proof, err := tree.Proof(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the two children of the first inner node hashed as a leaf of a tree
+	// of two leaves give the same root
+	left, right := sha256.Sum256(leaves[0]), sha256.Sum256(leaves[1])
+	forged := append(left[:], right[:]...)
+	forgedProof := MerkleProof{Index: 0, Leaves: 2, Hashes: proof.Hashes[1:]}
+
+	if VerifyMerkleProof(root, forged, forgedProof) {
+		t.Fatal("inner node verifies as a leaf")
+	}
+}
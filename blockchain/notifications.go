@@ -0,0 +1,41 @@
+package blockchain
+
+// Kinds of notification sent to the subscribers of the chain
+const (
+	// the block joined the main chain
+	BlockConnected = iota
+	// the block left the main chain during a reorganization
+	BlockDisconnected
+)
+
+type Notification struct {
+	Type  int
+	Block *Block
+}
+
+// Register a callback called every time the main chain changes
+func (chain *BlockChain) Subscribe(callback func(*Notification)) {
+	chain.subscribersLock.Lock()
+	defer chain.subscribersLock.Unlock()
+
+	chain.subscribers = append(chain.subscribers, callback)
+}
+
+func (chain *BlockChain) notify(kind int, block *Block) {
+	chain.subscribersLock.RLock()
+	defer chain.subscribersLock.RUnlock()
+
+	for _, callback := range chain.subscribers {
+		callback(&Notification{kind, block})
+	}
+}
+
+// Send the blocks which left the main chain first, then the ones which joined it
+func (chain *BlockChain) notifySwitch(sw *chainSwitch) {
+	for _, block := range sw.detach {
+		chain.notify(BlockDisconnected, block)
+	}
+	for _, block := range sw.attach {
+		chain.notify(BlockConnected, block)
+	}
+}
@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Settings of a network, the nodes of two networks don't talk to each other
+// and keep their data apart
+type ChainParams struct {
+	// name of the network, its data is kept into DataDir/Name
+	Name    string
+	DataDir string
+
+	// data of the coinbase of the genesis block
+	GenesisMessage string
+	// subsidy of the first blocks, halved every HalvingInterval blocks until
+	// it reaches 0, the coinbase can claim it with the fees of its block
+	Reward int
+	// 0 keeps the same subsidy forever
+	HalvingInterval int
+	// number of blocks on top of a coinbase before a block can spend it
+	CoinbaseMaturity int
+
+	// leading zero bits of the genesis block
+	InitialDifficulty int
+	// lowest difficulty the retarget can reach
+	MinDifficulty int
+	// number of blocks between two difficulty adjustments, 0 keeps the
+	// initial difficulty forever
+	RetargetInterval int
+	// expected time in seconds between two blocks
+	TargetBlockTime int64
+
+	// first bytes of every message between the nodes
+	Magic uint32
+	// nodes known at start, the first one is the central node
+	DefaultPeers []string
+}
+
+var (
+	MainNetParams = ChainParams{
+		Name:              "mainnet",
+		DataDir:           defaultDataDir(),
+		GenesisMessage:    "First Transaction from Genesis",
+		Reward:            20,
+		HalvingInterval:   100000,
+		CoinbaseMaturity:  100,
+		InitialDifficulty: 12,
+		MinDifficulty:     1,
+		RetargetInterval:  10,
+		TargetBlockTime:   10,
+		Magic:             0xb10c0001,
+		DefaultPeers:      []string{"localhost:3000"},
+	}
+
+	TestNetParams = ChainParams{
+		Name:              "testnet",
+		DataDir:           defaultDataDir(),
+		GenesisMessage:    "First Transaction from the Testnet Genesis",
+		Reward:            20,
+		HalvingInterval:   10000,
+		CoinbaseMaturity:  100,
+		InitialDifficulty: 8,
+		MinDifficulty:     1,
+		RetargetInterval:  10,
+		TargetBlockTime:   10,
+		Magic:             0xb10c0002,
+		DefaultPeers:      []string{"localhost:13000"},
+	}
+
+	// blocks are mined instantly and the difficulty never moves, a coinbase
+	// can be spent by the next block
+	RegTestParams = ChainParams{
+		Name:              "regtest",
+		DataDir:           defaultDataDir(),
+		GenesisMessage:    "First Transaction from the Regtest Genesis",
+		Reward:            20,
+		HalvingInterval:   150,
+		CoinbaseMaturity:  1,
+		InitialDifficulty: 1,
+		MinDifficulty:     1,
+		RetargetInterval:  0,
+		TargetBlockTime:   10,
+		Magic:             0xb10c0003,
+		DefaultPeers:      []string{"localhost:23000"},
+	}
+)
+
+// Directory of the data when none is configured
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "tmp"
+	}
+	return filepath.Join(home, ".blockchain-pow-go")
+}
+
+// Get a copy of the settings of a known network
+func NetworkParams(name string) (*ChainParams, error) {
+	var params ChainParams
+
+	switch name {
+	case MainNetParams.Name:
+		params = MainNetParams
+	case TestNetParams.Name:
+		params = TestNetParams
+	case RegTestParams.Name:
+		params = RegTestParams
+	default:
+		return nil, fmt.Errorf("Unknown network %s", name)
+	}
+
+	params.DefaultPeers = append([]string{}, params.DefaultPeers...)
+
+	return &params, nil
+}
+
+// Get the settings of the network overridden by the JSON config file then by
+// override, if any. The fields missing from the file keep the value of the
+// network, the settings are checked once every override is applied.
+func LoadParams(network, configFile string, override func(*ChainParams) error) (*ChainParams, error) {
+	params, err := NetworkParams(network)
+	if err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(data, params); err != nil {
+			return nil, fmt.Errorf("Invalid config file %s: %w", configFile, err)
+		}
+	}
+
+	if override != nil {
+		if err := override(params); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := params.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid parameters of the network %s: %w", params.Name, err)
+	}
+
+	return params, nil
+}
+
+// Check that the settings can run a chain
+func (params *ChainParams) Validate() error {
+	if params.Name == "" || params.DataDir == "" {
+		return fmt.Errorf("The network needs a name and a data directory")
+	}
+	if params.Reward < 0 || params.HalvingInterval < 0 {
+		return fmt.Errorf("Invalid reward %d halved every %d blocks", params.Reward, params.HalvingInterval)
+	}
+	if params.CoinbaseMaturity < 0 {
+		return fmt.Errorf("Invalid coinbase maturity %d", params.CoinbaseMaturity)
+	}
+	if params.MinDifficulty < MinDifficulty || params.InitialDifficulty < params.MinDifficulty || params.InitialDifficulty > MaxDifficulty {
+		return fmt.Errorf("Invalid difficulty %d, the min is %d", params.InitialDifficulty, params.MinDifficulty)
+	}
+	if params.RetargetInterval < 0 || params.RetargetInterval == 1 || params.TargetBlockTime <= 0 {
+		return fmt.Errorf("Invalid retarget every %d blocks of %ds", params.RetargetInterval, params.TargetBlockTime)
+	}
+	if len(params.DefaultPeers) == 0 {
+		return fmt.Errorf("The network needs at least one peer")
+	}
+	return nil
+}
+
+// Get the directory of the blocks of the node
+func (params *ChainParams) ChainPath(nodeID string) string {
+	return filepath.Join(params.DataDir, params.Name, fmt.Sprintf("blocks_%s", nodeID))
+}
+
+// Get the file of the wallets of the node
+func (params *ChainParams) WalletPath(nodeID string) string {
+	return filepath.Join(params.DataDir, params.Name, fmt.Sprintf("wallets_%s.data", nodeID))
+}
+
+// Get the subsidy of the block at the height
+func (params *ChainParams) Subsidy(height int) int {
+	if params.HalvingInterval == 0 {
+		return params.Reward
+	}
+
+	halvings := height / params.HalvingInterval
+	// shifting by the size of an int or more is 0 already
+	if halvings >= strconv.IntSize {
+		return 0
+	}
+
+	return params.Reward >> uint(halvings)
+}
+
+// Get the supply once every subsidy up to the height is issued
+func (params *ChainParams) ScheduledSupply(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	supply := 0
+
+	if params.HalvingInterval == 0 {
+		return params.Reward * (height + 1)
+	}
+
+	// sum the subsidy by runs of blocks with the same subsidy
+	for start := 0; start <= height; start += params.HalvingInterval {
+		subsidy := params.Subsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		end := start + params.HalvingInterval - 1
+		if end > height {
+			end = height
+		}
+		supply += subsidy * (end - start + 1)
+	}
+
+	return supply
+}
+
+// Get the supply once every subsidy is issued, -1 when the subsidy is never
+// halved
+func (params *ChainParams) MaxSupply() int {
+	if params.HalvingInterval == 0 {
+		return -1
+	}
+
+	supply := 0
+	for subsidy := params.Reward; subsidy > 0; subsidy >>= 1 {
+		supply += subsidy * params.HalvingInterval
+	}
+	return supply
+}
+
+// Get the most an output or the outputs of a transaction can hold, the max
+// supply or the largest int when the subsidy is never halved
+func (params *ChainParams) MaxMoney() int {
+	if supply := params.MaxSupply(); supply >= 0 {
+		return supply
+	}
+	return int(^uint(0) >> 1)
+}
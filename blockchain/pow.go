@@ -1,12 +1,17 @@
 package blockchain
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Take the data from the block
@@ -20,76 +25,178 @@ import (
 // Requirements :
 // The first few bytes must contains 0s
 
-const Difficulty = 12
+// The difficulty is the number of leading zero bits the block hash must have.
+// It starts at the initial difficulty of the network and is recomputed every
+// retarget interval, always between these bounds.
+const (
+	MinDifficulty = 1
+	MaxDifficulty = 255
+)
+
+// Number of hashes a worker computes between two checks of the cancellation
+const cancelCheckInterval = 1 << 12
+
+var (
+	ErrNonceExhausted  = errors.New("No nonce gives a valid hash")
+	ErrDifficultyRange = errors.New("Difficulty is out of range")
+)
 
 type ProofOfWork struct {
-	Block  *Block
+	Header *BlockHeader
 	Target *big.Int
+
+	// filled by the last run
+	Hashes  int64
+	Elapsed time.Duration
+}
+
+type powResult struct {
+	nonce int
+	hash  []byte
 }
 
 func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	pow := &ProofOfWork{b, target}
+	return NewHeaderProof(&b.BlockHeader)
+}
+
+// The proof of work covers the header alone, it is checked without the body.
+// The target of a difficulty out of range is nil, such a header never passes
+// Validate and can't be mined.
+func NewHeaderProof(h *BlockHeader) *ProofOfWork {
+	target, _ := DifficultyToTarget(h.Bits)
+	pow := &ProofOfWork{Header: h, Target: target}
 	return pow
 }
 
+// Convert a difficulty into the target the hash must be lower than, the
+// difficulty is checked first as it comes from the peers
+func DifficultyToTarget(difficulty int) (*big.Int, error) {
+	if difficulty < MinDifficulty || difficulty > MaxDifficulty {
+		return nil, fmt.Errorf("%w: %d", ErrDifficultyRange, difficulty)
+	}
+
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-difficulty))
+	return target, nil
+}
+
+// Get the header data with the nonce
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransaction(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
+	data := pow.Header.Bytes()
+	putNonce(data, nonce)
 	return data
 }
 
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	ErrorHandler(err)
-	return buff.Bytes()
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+	return buff
 }
 
-// function to bluid the hash of the block
+// function to bluid the hash of the block, on every CPU
 func (pow *ProofOfWork) Run() (int, []byte) {
+	nonce, hash, _ := pow.RunContext(context.Background(), 0)
+	return nonce, hash
+}
+
+// Search the nonce on several workers, the worker i tries the nonces i,
+// i+workers, i+2*workers... The search stops on the first valid hash or when
+// the context is done, 0 workers means one worker per CPU.
+func (pow *ProofOfWork) RunContext(ctx context.Context, workers int) (int, []byte, error) {
+	if pow.Target == nil {
+		return 0, nil, fmt.Errorf("%w: %d", ErrDifficultyRange, pow.Header.Bits)
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	pow.Hashes = 0
+
+	// cancelled by the first worker finding a valid hash
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// every worker can find a hash before seeing the cancellation
+	results := make(chan powResult, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			pow.search(searchCtx, cancel, first, workers, results)
+		}(i)
+	}
+	wg.Wait()
+
+	pow.Elapsed = time.Since(start)
+
+	select {
+	case result := <-results:
+		return result.nonce, result.hash, nil
+	default:
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	return 0, nil, ErrNonceExhausted
+}
+
+// Try the nonces from first by step until a valid hash or the cancellation
+func (pow *ProofOfWork) search(ctx context.Context, cancel context.CancelFunc, first, step int, results chan<- powResult) {
 	var intHash big.Int
-	var hash [32]byte
+	var hashes int64
 
-	nonce := 0
+	defer func() { atomic.AddInt64(&pow.Hashes, hashes) }()
 
-	// Validation Loop for sign the block
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+	// only the nonce changes between two hashes
+	data := pow.InitData(first)
 
-		fmt.Printf("\r%x", hash)
-		intHash.SetBytes(hash[:])
+	for nonce := first; ; nonce += step {
+		if hashes%cancelCheckInterval == 0 && ctx.Err() != nil {
+			return
+		}
+
+		putNonce(data, nonce)
+		hash := sha256.Sum256(data)
+		hashes++
 
 		// test case for hash match
+		intHash.SetBytes(hash[:])
 		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+			results <- powResult{nonce, hash[:]}
+			cancel()
+			return
 		}
-	}
 
-	fmt.Println()
+		if nonce > math.MaxInt64-step {
+			return
+		}
+	}
+}
 
-	return nonce, hash[:]
+// Hashes per second of the last run
+func (pow *ProofOfWork) HashRate() float64 {
+	seconds := pow.Elapsed.Seconds()
+	if seconds == 0 {
+		return 0
+	}
+	return float64(pow.Hashes) / seconds
 }
 
-// Function to validate the hash of the block
+// Function to validate the hash of the header
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
-	data := pow.InitData(pow.Block.Nonce)
+	// the target is nil out of the range
+	if pow.Target == nil || pow.Header.Bits < MinDifficulty || pow.Header.Bits > MaxDifficulty {
+		return false
+	}
 
-	hash := sha256.Sum256(data)
-	intHash.SetBytes(hash[:])
+	intHash.SetBytes(pow.Header.ComputeHash())
 
 	return intHash.Cmp(pow.Target) == -1
 }
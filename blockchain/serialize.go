@@ -0,0 +1,36 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/savecomdev/blockchain-pow-go/codec"
+)
+
+// Encode a value of the package into its canonical form, the encoded types
+// are fixed so an error is a programming error
+func encode(value interface{}) []byte {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// Decode data stored or received into the value
+func decode(data []byte, value interface{}) error {
+	if err := codec.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("%w: %s", ErrDecode, err)
+	}
+	return nil
+}
+
+// Decode a value stored with gob by the previous versions, only the migration
+// of the old databases reads it
+func gobDecode(data []byte, value interface{}) error {
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(value); err != nil {
+		return fmt.Errorf("%w: %s", ErrDecode, err)
+	}
+	return nil
+}
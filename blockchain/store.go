@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"errors"
+	"math/big"
+)
+
+// Returned by the callback of a ForEach method to stop the iteration early,
+// the ForEach method returns nil then
+var ErrStopIteration = errors.New("Stop the iteration")
+
+// Storage of the chain, every change made into one Update is applied at
+// once or not at all
+type ChainStore interface {
+	// run a read only transaction
+	View(fn func(txn StoreTxn) error) error
+	// run a read/write transaction, the changes are dropped when fn fails
+	Update(fn func(txn StoreTxn) error) error
+	Close() error
+}
+
+// Transaction on a ChainStore, the Get methods returning a pointer return nil
+// when the value is not stored
+type StoreTxn interface {
+	// blocks of every branch by hash, the header and the body of a block
+	// are kept apart so a header can be stored before its body
+	GetBlock(hash []byte) (*Block, error)
+	HasBlock(hash []byte) (bool, error)
+	PutBlock(block *Block) error
+	GetHeader(hash []byte) (*BlockHeader, error)
+	PutHeader(hash []byte, header *BlockHeader) error
+
+	// hash of the tip of the main chain
+	GetTip() ([]byte, error)
+	SetTip(hash []byte) error
+
+	// cumulative work of the chain ending with the block
+	GetWork(hash []byte) (*big.Int, error)
+	PutWork(hash []byte, work *big.Int) error
+
+	// undo data of the blocks of the main chain
+	GetUndo(hash []byte) (*BlockUndo, error)
+	PutUndo(hash []byte, undo *BlockUndo) error
+
+	// hashes of the main chain blocks by height
+	GetHashByHeight(height int) ([]byte, error)
+	PutHeight(height int, hash []byte) error
+	DeleteHeight(height int) error
+	BestHeight() (int, error)
+
+	// unspent outputs by transaction
+	GetOutputs(txID []byte) (TxOutputs, bool, error)
+	PutOutputs(txID []byte, outs TxOutputs) error
+	DeleteOutputs(txID []byte) error
+	ForEachOutputs(fn func(txID []byte, outs TxOutputs) error) error
+	ClearOutputs() error
+
+	// transaction index
+	GetTxLocation(txID []byte) (*TxLocation, error)
+	PutTxLocation(txID []byte, loc TxLocation) error
+	DeleteTxLocation(txID []byte) error
+
+	// address index, the events of an address are sorted by height then by
+	// position into the block
+	PutAddrEvent(pubKeyHash []byte, height, position int, event AddrEvent) error
+	DeleteAddrEvent(pubKeyHash []byte, height, position int) error
+	ForEachAddrEvent(pubKeyHash []byte, fn func(event AddrEvent) error) error
+
+	// settings stored with the chain
+	HasFlag(name string) (bool, error)
+	SetFlag(name string) error
+}
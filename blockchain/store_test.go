@@ -0,0 +1,199 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// Run the test on every ChainStore
+func forEachStore(t *testing.T, test func(t *testing.T, store ChainStore)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+
+	t.Run("badger", func(t *testing.T) {
+		store, err := NewBadgerStore(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		test(t, store)
+	})
+}
+
+func hashOf(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func bestHeight(t *testing.T, store ChainStore) (height int, err error) {
+	t.Helper()
+
+	store.View(func(txn StoreTxn) error {
+		height, err = txn.BestHeight()
+		return nil
+	})
+	return height, err
+}
+
+func TestStoreHeights(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ChainStore) {
+		if _, err := bestHeight(t, store); !errors.Is(err, ErrHeightNotFound) {
+			t.Fatalf("expected %s, got %v", ErrHeightNotFound, err)
+		}
+
+		err := store.Update(func(txn StoreTxn) error {
+			for height := 0; height <= 3; height++ {
+				if err := txn.PutHeight(height, hashOf(byte(height))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height, err := bestHeight(t, store); err != nil || height != 3 {
+			t.Fatalf("best height %d, %v, expected 3", height, err)
+		}
+
+		// a failed update leaves the heights as they were
+		failure := errors.New("failure")
+		err = store.Update(func(txn StoreTxn) error {
+			if err := txn.DeleteHeight(3); err != nil {
+				return err
+			}
+			if err := txn.PutHeight(4, hashOf(4)); err != nil {
+				return err
+			}
+			return failure
+		})
+		if !errors.Is(err, failure) {
+			t.Fatalf("expected %s, got %v", failure, err)
+		}
+		if height, err := bestHeight(t, store); err != nil || height != 3 {
+			t.Fatalf("best height %d, %v after a failed update, expected 3", height, err)
+		}
+
+		err = store.Update(func(txn StoreTxn) error {
+			if err := txn.DeleteHeight(3); err != nil {
+				return err
+			}
+			return txn.DeleteHeight(2)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height, err := bestHeight(t, store); err != nil || height != 1 {
+			t.Fatalf("best height %d, %v, expected 1", height, err)
+		}
+
+		store.View(func(txn StoreTxn) error {
+			if hash, err := txn.GetHashByHeight(1); err != nil || !bytes.Equal(hash, hashOf(1)) {
+				t.Errorf("hash %x, %v at height 1", hash, err)
+			}
+			if _, err := txn.GetHashByHeight(2); !errors.Is(err, ErrHeightNotFound) {
+				t.Errorf("expected %s, got %v", ErrHeightNotFound, err)
+			}
+			return nil
+		})
+	})
+}
+
+func TestStoreBlocks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ChainStore) {
+		coinbase := &Transaction{
+			Inputs:  []TxInput{{ID: []byte{}, Out: -1, Signature: heightCommitment(1), PubKey: []byte("data")}},
+			Outputs: []TxOutput{{Value: 20, PubKeyHash: make([]byte, 20)}},
+		}
+		coinbase.ID = coinbase.Hash()
+		block := NewBlock([]*Transaction{coinbase}, hashOf(9), 1, MinDifficulty)
+		block.Hash = block.ComputeHash()
+
+		err := store.Update(func(txn StoreTxn) error {
+			if err := txn.PutBlock(block); err != nil {
+				return err
+			}
+			if err := txn.SetTip(block.Hash); err != nil {
+				return err
+			}
+			return txn.PutWork(block.Hash, big.NewInt(2))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store.View(func(txn StoreTxn) error {
+			stored, err := txn.GetBlock(block.Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored.Serialize(), block.Serialize()) {
+				t.Error("the stored block differs")
+			}
+
+			if tip, err := txn.GetTip(); err != nil || !bytes.Equal(tip, block.Hash) {
+				t.Errorf("tip %x, %v", tip, err)
+			}
+			if work, err := txn.GetWork(block.Hash); err != nil || work.Int64() != 2 {
+				t.Errorf("work %v, %v", work, err)
+			}
+
+			if header, err := txn.GetHeader(hashOf(1)); err != nil || header != nil {
+				t.Errorf("header %v, %v of a missing block", header, err)
+			}
+			if found, err := txn.HasBlock(hashOf(1)); err != nil || found {
+				t.Errorf("missing block found, %v", err)
+			}
+			return nil
+		})
+	})
+}
+
+func TestStoreOutputs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store ChainStore) {
+		outs := TxOutputs{}
+		outs.Add(1, TxOutput{Value: 5, PubKeyHash: []byte{1}})
+
+		err := store.Update(func(txn StoreTxn) error {
+			for _, b := range []byte{3, 1, 2} {
+				if err := txn.PutOutputs(hashOf(b), outs); err != nil {
+					return err
+				}
+			}
+			return txn.DeleteOutputs(hashOf(2))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		store.View(func(txn StoreTxn) error {
+			var IDs [][]byte
+			txn.ForEachOutputs(func(txID []byte, stored TxOutputs) error {
+				IDs = append(IDs, txID)
+				if out, ok := stored.Find(1); !ok || out.Value != 5 {
+					t.Errorf("outputs of %x: %+v", txID, stored)
+				}
+				return nil
+			})
+			// sorted by transaction ID
+			if len(IDs) != 2 || !bytes.Equal(IDs[0], hashOf(1)) || !bytes.Equal(IDs[1], hashOf(3)) {
+				t.Errorf("outputs of %x", IDs)
+			}
+
+			if _, found, err := txn.GetOutputs(hashOf(2)); err != nil || found {
+				t.Errorf("deleted outputs found, %v", err)
+			}
+			return nil
+		})
+
+		err = store.View(func(txn StoreTxn) error {
+			return txn.PutOutputs(hashOf(4), outs)
+		})
+		if err == nil {
+			t.Error("a read only transaction changed the outputs")
+		}
+	})
+}
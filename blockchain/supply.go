@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrSupplyMismatch = errors.New("Issued supply doesn't match the UTXO set")
+
+// Supply of the main chain at a height
+type Supply struct {
+	Height int
+	// value created by the coinbases up to the height, without the fees they
+	// collected
+	Issued int
+	// value the subsidy schedule allows up to the height
+	Scheduled int
+	// value of the UTXO set, only known at the tip, -1 below it
+	Unspent int
+}
+
+// Compute the supply issued by the main chain up to the height. At the tip
+// the issued supply is checked against the UTXO set, every output created is
+// either spent or into the set.
+func (chain *BlockChain) GetSupply(height int) (*Supply, error) {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+	if height < 0 || height > bestHeight {
+		return nil, fmt.Errorf("%w: %d", ErrHeightNotFound, height)
+	}
+
+	supply := &Supply{
+		Height:    height,
+		Scheduled: chain.Params.ScheduledSupply(height),
+		Unspent:   -1,
+	}
+
+	// a block creates the value of its outputs minus the value it spends
+	for h := 0; h <= height; h++ {
+		block, err := chain.GetBlockByHeight(h)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tx := range block.Transactions {
+			for _, out := range tx.Outputs {
+				supply.Issued += out.Value
+			}
+		}
+
+		undo, err := chain.GetBlockUndo(&block)
+		if err != nil {
+			return nil, err
+		}
+		for _, out := range undo.Spent {
+			supply.Issued -= out.Value
+		}
+	}
+
+	if height == bestHeight {
+		UTXO := UTXOSet{chain}
+		if supply.Unspent, err = UTXO.TotalValue(); err != nil {
+			return nil, err
+		}
+
+		if supply.Unspent != supply.Issued {
+			return supply, fmt.Errorf("%w: %d issued, %d unspent", ErrSupplyMismatch, supply.Issued, supply.Unspent)
+		}
+	}
+
+	return supply, nil
+}
@@ -1,25 +1,21 @@
 package blockchain
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 
 	"github.com/savecomdev/blockchain-pow-go/wallet"
 )
 
-var (
-	defaultReward = 20
-)
-
+// The fields of the transactions, inputs and outputs are in the order of
+// their canonical encoding, the ID is the hash of the encoding without it
 type Transaction struct {
 	ID      []byte
 	Inputs  []TxInput
@@ -27,83 +23,228 @@ type Transaction struct {
 }
 
 // Convert a slice of byte into a Transaction
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
-
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
-	ErrorHandler(err)
-	return transaction
+	err := decode(data, &transaction)
+	return transaction, err
 }
 
-// Convert a transaction into a slice of byte
+// Convert a transaction into its canonical encoding
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	return encode(tx)
+}
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	ErrorHandler(err)
+// Position of the change into the outputs of the transactions of the wallet,
+// after the payment
+const ChangeOutput = 1
 
-	return encoded.Bytes()
+// Build a transaction paying the amount to the address, the fee is left to
+// the miner as the difference between the inputs and the outputs
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	return NewTransactionFrom(w, to, amount, fee, false, UTXO.Blockchain, UTXO)
 }
 
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// Build a transaction spending outputs of the set, the outputs of the memory
+// pool can be spent through an overlay of the UTXO set. The inputs of a
+// replaceable transaction signal it with their sequence, so its fee can be
+// bumped while it waits into the pools.
+func NewTransactionFrom(w *wallet.Wallet, to string, amount, fee int, replaceable bool, chain *BlockChain, outputs OutputSet) (*Transaction, error) {
 	var inputs []TxInput
-	var outputs []TxOutput
+	var prevOuts []TxOutput
+	var txOutputs []TxOutput
+
+	sequence := 0
+	if replaceable {
+		sequence = SequenceReplaceable
+	}
+
+	if amount <= 0 || fee < 0 {
+		return nil, fmt.Errorf("%w: amount %d with fee %d", ErrInvalidTx, amount, fee)
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
 
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendabaleOutputs(pubKeyHash, amount)
+	acc, validOutputs, err := FindSpendableOutputs(outputs, pubKeyHash, amount+fee, bestHeight+1, chain.Params.CoinbaseMaturity)
+	if err != nil {
+		return nil, err
+	}
 
-	if acc < amount {
-		log.Panic("Error: Not anougth funds for this transaction !!")
+	if acc < amount+fee {
+		return nil, fmt.Errorf("%w: %d available, %d needed", ErrNotEnoughFunds, acc, amount+fee)
 	}
 
 	for txid, outs := range validOutputs {
 		txID, err := hex.DecodeString(txid)
-		ErrorHandler(err)
+		if err != nil {
+			return nil, err
+		}
+
+		unspent, _, err := outputs.FindOutputs(txID)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+		for _, outIdx := range outs {
+			prevOut, ok := unspent.Find(outIdx)
+			if !ok {
+				return nil, fmt.Errorf("%w: %x:%d", ErrOutputNotFound, txID, outIdx)
+			}
+
+			input := TxInput{txID, OutPoint(outIdx, sequence), nil, w.PublicKey}
 			inputs = append(inputs, input)
+			prevOuts = append(prevOuts, prevOut)
 		}
 	}
 
 	from := fmt.Sprintf("%s", w.Address())
 
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	output, err := NewTXOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
+	txOutputs = append(txOutputs, *output)
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	// the change follows the payment, see ChangeOutput
+	if acc > amount+fee {
+		change, err := NewTXOutput(acc-amount-fee, from)
+		if err != nil {
+			return nil, err
+		}
+		txOutputs = append(txOutputs, *change)
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{nil, inputs, txOutputs}
+	if err := tx.SignOutputs(w.PrivateKey, prevOuts); err != nil {
+		return nil, err
+	}
+	// the ID commits to the signatures, so it is computed once they are set
 	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
 
-	return &tx
+	return &tx, nil
 }
 
-func CoinBaseTx(to, data string) *Transaction {
+// Rebuild a replaceable transaction of the wallet from the same inputs with a
+// fee higher by the amount, taken on its change. The new transaction replaces
+// the old one into the pools and can be bumped in turn.
+func BumpFee(w *wallet.Wallet, tx *Transaction, amount int) (*Transaction, error) {
+	if tx.IsCoinbase() || amount <= 0 {
+		return nil, fmt.Errorf("%w: bumping %x by %d", ErrInvalidTx, tx.ID, amount)
+	}
+	if !tx.Replaceable() {
+		return nil, fmt.Errorf("%w: %x isn't replaceable", ErrInvalidTx, tx.ID)
+	}
+
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	var inputs []TxInput
+	var prevOuts []TxOutput
+	for _, in := range tx.Inputs {
+		if !in.UsesKey(pubKeyHash) {
+			return nil, fmt.Errorf("%w: %x spends outputs of another wallet", ErrInvalidTx, tx.ID)
+		}
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, w.PublicKey})
+		// the signature commits to the key of the spent output, not to its
+		// value
+		prevOuts = append(prevOuts, TxOutput{0, pubKeyHash})
+	}
+
+	// the payment can come back to the wallet too, the change is found by
+	// its position
+	change := ChangeOutput
+	if len(tx.Outputs) <= change || !tx.Outputs[change].IsLockedWithKey(pubKeyHash) {
+		return nil, fmt.Errorf("%w: %x has no change", ErrNotEnoughFunds, tx.ID)
+	}
+	if tx.Outputs[change].Value < amount {
+		return nil, fmt.Errorf("%w: the change of %x can't pay %d more", ErrNotEnoughFunds, tx.ID, amount)
+	}
+
+	var outputs []TxOutput
+	for i, out := range tx.Outputs {
+		if i == change {
+			out.Value -= amount
+			if out.Value == 0 {
+				continue
+			}
+		}
+		outputs = append(outputs, out)
+	}
+
+	newTx := Transaction{nil, inputs, outputs}
+	if err := newTx.SignOutputs(w.PrivateKey, prevOuts); err != nil {
+		return nil, err
+	}
+	newTx.ID = newTx.Hash()
+
+	return &newTx, nil
+}
+
+// Build the coinbase of the block at the height. A coinbase has no signature,
+// the place of the signature holds the height so two coinbases paying the
+// same reward to the same address never share their ID.
+func CoinBaseTx(to, data string, height, reward int) (*Transaction, error) {
 	if data == "" {
 		randData := make([]byte, 24)
-		_, err := rand.Read(randData)
-		ErrorHandler(err)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
 		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(defaultReward, to)
+	txin := TxInput{[]byte{}, -1, heightCommitment(height), []byte(data)}
+	txout, err := NewTXOutput(reward, to)
+	if err != nil {
+		return nil, err
+	}
 
 	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
 	tx.ID = tx.Hash()
 
-	return &tx
+	return &tx, nil
+}
+
+// Encode the height a coinbase commits to
+func heightCommitment(height int) []byte {
+	commitment := make([]byte, 8)
+	binary.BigEndian.PutUint64(commitment, uint64(height))
+	return commitment
+}
+
+// Get the height the coinbase commits to, false when the transaction isn't a
+// coinbase or doesn't commit to a height
+func (tx *Transaction) CoinbaseHeight() (int, bool) {
+	if !tx.IsCoinbase() || len(tx.Inputs[0].Signature) != 8 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint64(tx.Inputs[0].Signature)), true
+}
+
+// Get the size of the canonical encoding, the fee rate is the fee by byte
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
 }
 
 func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
+// Check if an input signals the transaction can be replaced into the pools by
+// one paying more
+func (tx *Transaction) Replaceable() bool {
+	if tx.IsCoinbase() {
+		return false
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence() == SequenceReplaceable {
+			return true
+		}
+	}
+	return false
+}
+
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 
@@ -135,34 +276,62 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 }
 
 // function to sign a transaction
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	// don't need to sign the first transaction
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct!!!")
+	prevOuts := make([]TxOutput, len(tx.Inputs))
+
+	for inId, in := range tx.Inputs {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
+			return fmt.Errorf("%w: %x", ErrPrevTxNotFound, in.ID)
+		}
+		if in.Index() >= len(prevTx.Outputs) {
+			return fmt.Errorf("%w: %x has no output %d", ErrInvalidTx, in.ID, in.Index())
 		}
+		prevOuts[inId] = prevTx.Outputs[in.Index()]
+	}
+
+	return tx.SignOutputs(privKey, prevOuts)
+}
+
+// Sign the inputs with the outputs they spend, prevOuts[i] is the output
+// spent by the input i
+func (tx *Transaction) SignOutputs(privKey ecdsa.PrivateKey, prevOuts []TxOutput) error {
+	// don't need to sign the first transaction
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	if len(prevOuts) != len(tx.Inputs) {
+		return fmt.Errorf("%w: %d inputs for %d spent outputs", ErrInvalidTx, len(tx.Inputs), len(prevOuts))
 	}
 
 	// create copy for work
 	txCopy := tx.TrimmedCopy()
 
-	for inId, in := range txCopy.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+	for inId := range txCopy.Inputs {
 		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
+		txCopy.Inputs[inId].PubKey = prevOuts[inId].PubKeyHash
 		txCopy.ID = txCopy.Hash()
 		txCopy.Inputs[inId].PubKey = nil
 
 		// build the signature of the transaction
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		ErrorHandler(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		if err != nil {
+			return err
+		}
+		// r and s take the same width so the signature is split in halves
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 		tx.Inputs[inId].Signature = signature
 	}
+
+	return nil
 }
 
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
@@ -171,10 +340,32 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		return true
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction doesn't exist!!!")
+	prevOuts := make([]TxOutput, len(tx.Inputs))
+
+	for inId, in := range tx.Inputs {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
+			return false
 		}
+		if in.Index() >= len(prevTx.Outputs) {
+			return false
+		}
+		prevOuts[inId] = prevTx.Outputs[in.Index()]
+	}
+
+	return tx.VerifyOutputs(prevOuts)
+}
+
+// Verify the inputs against the outputs they spend, prevOuts[i] is the
+// output spent by the input i
+func (tx *Transaction) VerifyOutputs(prevOuts []TxOutput) bool {
+	// don't need to sign the first transaction
+	if tx.IsCoinbase() {
+		return true
+	}
+
+	if len(prevOuts) != len(tx.Inputs) {
+		return false
 	}
 
 	// create copy for work
@@ -182,15 +373,22 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	curve := elliptic.P256()
 
 	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		// the key of the input must own the output it spends
+		if !in.UsesKey(prevOuts[inId].PubKeyHash) {
+			return false
+		}
+
 		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
+		txCopy.Inputs[inId].PubKey = prevOuts[inId].PubKeyHash
 		txCopy.ID = txCopy.Hash()
 		txCopy.Inputs[inId].PubKey = nil
 
 		r := big.Int{}
 		s := big.Int{}
 		sigLen := len(in.Signature)
+		if sigLen == 0 || len(in.PubKey) == 0 {
+			return false
+		}
 		r.SetBytes(in.Signature[:(sigLen / 2)])
 		s.SetBytes(in.Signature[(sigLen / 2):])
 
@@ -200,7 +398,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 		if !ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) {
 			return false
 		}
@@ -217,7 +415,8 @@ func (tx Transaction) String() string {
 	for i, input := range tx.Inputs {
 		lines = append(lines, fmt.Sprintf("		Input: %d", i))
 		lines = append(lines, fmt.Sprintf("			TXID: %x", input.ID))
-		lines = append(lines, fmt.Sprintf("			Out: %d", input.Out))
+		lines = append(lines, fmt.Sprintf("			Out: %d", input.Index()))
+		lines = append(lines, fmt.Sprintf("			Sequence: %d", input.Sequence()))
 		lines = append(lines, fmt.Sprintf("			Signature: %x", input.Signature))
 		lines = append(lines, fmt.Sprintf("			PubKey: %x", input.PubKey))
 	}
@@ -2,7 +2,6 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
 
 	"github.com/savecomdev/blockchain-pow-go/wallet"
 )
@@ -12,10 +11,20 @@ type TxOutput struct {
 	PubKeyHash []byte
 }
 
+// Unspent outputs of a transaction, Indexes holds the position of each
+// output into the transaction which created it. Height is the one of the
+// block holding the transaction, the outputs of a coinbase wait for the
+// maturity before they can be spent.
 type TxOutputs struct {
-	Outputs []TxOutput
+	Outputs  []TxOutput
+	Indexes  []int
+	Height   int
+	Coinbase bool
 }
 
+// Out holds the index of the spent output in its low 32 bits and the sequence
+// of the input above them, see OutPoint. The inputs written before the
+// sequence have a sequence of 0.
 type TxInput struct {
 	ID        []byte
 	Out       int
@@ -23,11 +32,39 @@ type TxInput struct {
 	PubKey    []byte
 }
 
-func NewTXOutput(value int, address string) *TxOutput {
+const (
+	// bits of Out holding the index of the spent output
+	indexBits = 32
+
+	// sequence of an input which doesn't let its transaction be replaced
+	SequenceFinal = 0
+	// sequence of an input letting its transaction be replaced into the
+	// pools by one paying more
+	SequenceReplaceable = 1
+)
+
+// Get the Out of an input spending the output at the index with the sequence
+func OutPoint(index, sequence int) int {
+	return index | sequence<<indexBits
+}
+
+// Get the index of the output spent by the input
+func (in *TxInput) Index() int {
+	return in.Out & (1<<indexBits - 1)
+}
+
+// Get the sequence of the input
+func (in *TxInput) Sequence() int {
+	return in.Out >> indexBits
+}
+
+func NewTXOutput(value int, address string) (*TxOutput, error) {
 	txo := &TxOutput{value, nil}
-	txo.Lock([]byte(address))
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
 
-	return txo
+	return txo, nil
 }
 
 func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
@@ -35,28 +72,58 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Equal(lockingHash, pubKeyHash)
 }
 
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+func (out *TxOutput) Lock(address []byte) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(string(address))
+	if err != nil {
+		return err
+	}
 	out.PubKeyHash = pubKeyHash
+	return nil
 }
 
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 	return bytes.Equal(out.PubKeyHash, pubKeyHash)
 }
 
+// Get the unspent output created at the index of the transaction
+func (outs TxOutputs) Find(index int) (TxOutput, bool) {
+	for i, outIdx := range outs.Indexes {
+		if outIdx == index {
+			return outs.Outputs[i], true
+		}
+	}
+	return TxOutput{}, false
+}
+
+// Add an unspent output created at the index of the transaction
+func (outs *TxOutputs) Add(index int, out TxOutput) {
+	outs.Outputs = append(outs.Outputs, out)
+	outs.Indexes = append(outs.Indexes, index)
+}
+
+// Copy the outputs without the one created at the index of the transaction
+func (outs TxOutputs) Remove(index int) TxOutputs {
+	updatedOuts := TxOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+	for i, outIdx := range outs.Indexes {
+		if outIdx != index {
+			updatedOuts.Add(outIdx, outs.Outputs[i])
+		}
+	}
+	return updatedOuts
+}
+
+// Check if the outputs can be spent by a block at the height, the outputs of
+// a coinbase need maturity blocks on top of the one holding it
+func (outs TxOutputs) IsMature(height, maturity int) bool {
+	return !outs.Coinbase || height-outs.Height >= maturity
+}
+
 func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	ErrorHandler(err)
-	return buffer.Bytes()
+	return encode(outs)
 }
 
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	ErrorHandler(err)
-	return outputs
+	err := decode(data, &outputs)
+	return outputs, err
 }
@@ -0,0 +1,141 @@
+package blockchain
+
+import "fmt"
+
+const txIndexFlag = "txindex"
+
+// Position of a main chain transaction, stored into the transaction index
+type TxLocation struct {
+	BlockHash []byte
+	Position  int
+}
+
+// Transaction of the main chain with the block which holds it
+type TxInfo struct {
+	Transaction   Transaction
+	BlockHash     []byte
+	Height        int
+	Confirmations int
+}
+
+func (loc TxLocation) Serialize() []byte {
+	return encode(loc)
+}
+
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	var loc TxLocation
+	err := decode(data, &loc)
+	return loc, err
+}
+
+// Check if the transaction index is kept by the chain
+func (chain *BlockChain) HasTxIndex() bool {
+	found := false
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		found, err = txn.HasFlag(txIndexFlag)
+		return err
+	})
+	return err == nil && found
+}
+
+// Index the transactions of the main chain and keep the index up to date
+// from now on, the choice is stored with the chain
+func (chain *BlockChain) EnableTxIndex() error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+
+	if chain.txIndex {
+		return nil
+	}
+
+	iter := chain.ForwardIterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			break
+		}
+
+		err = chain.Store.Update(func(txn StoreTxn) error {
+			return indexBlockTransactions(txn, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err := chain.Store.Update(func(txn StoreTxn) error {
+		return txn.SetFlag(txIndexFlag)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.txIndex = true
+
+	return nil
+}
+
+// Add the transactions of a block joining the main chain into the index
+func indexBlockTransactions(txn StoreTxn, block *Block) error {
+	for pos, tx := range block.Transactions {
+		if err := txn.PutTxLocation(tx.ID, TxLocation{block.Hash, pos}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the transactions of a block leaving the main chain from the index
+func unindexBlockTransactions(txn StoreTxn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.DeleteTxLocation(tx.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Search a transaction into the index, nil when the main chain doesn't hold it
+func (chain *BlockChain) findIndexedTransaction(ID []byte) (*Transaction, *Block, error) {
+	var loc *TxLocation
+
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		loc, err = txn.GetTxLocation(ID)
+		return err
+	})
+	if err != nil || loc == nil {
+		return nil, nil, err
+	}
+
+	block, err := chain.GetBlock(loc.BlockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if loc.Position < 0 || loc.Position >= len(block.Transactions) {
+		return nil, nil, fmt.Errorf("%w: index points outside of block %x", ErrTxNotFound, block.Hash)
+	}
+
+	return block.Transactions[loc.Position], &block, nil
+}
+
+// Get a main chain transaction with its height and its number of confirmations
+func (chain *BlockChain) GetTransaction(ID []byte) (*TxInfo, error) {
+	tx, block, err := chain.findTransaction(ID)
+	if err != nil {
+		return nil, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	confirmations := bestHeight - block.Height + 1
+
+	return &TxInfo{*tx, block.Hash, block.Height, confirmations}, nil
+}
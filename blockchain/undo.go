@@ -0,0 +1,75 @@
+package blockchain
+
+// Outputs spent by the transactions of a block in the order of their inputs,
+// stored with the block to disconnect it without scanning the chain
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+// Output spent by a block with the height and the kind of the transaction
+// which created it, to put it back into the set as it was
+type SpentOutput struct {
+	TxOutput
+	Height   int
+	Coinbase bool
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	return encode(undo)
+}
+
+func DeserializeUndo(data []byte) (*BlockUndo, error) {
+	var undo BlockUndo
+	if err := decode(data, &undo); err != nil {
+		return nil, err
+	}
+	return &undo, nil
+}
+
+// Get the undo data of a block, the blocks stored before the undo data was
+// recorded get it rebuilt from the transactions of the main chain
+func (chain *BlockChain) GetBlockUndo(block *Block) (*BlockUndo, error) {
+	var undo *BlockUndo
+
+	err := chain.Store.View(func(txn StoreTxn) (err error) {
+		undo, err = txn.GetUndo(block.Hash)
+		return err
+	})
+	if err != nil || undo != nil {
+		return undo, err
+	}
+
+	undo = &BlockUndo{}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			spent, err := chain.spentOutput(in)
+			if err != nil {
+				return nil, err
+			}
+			undo.Spent = append(undo.Spent, spent)
+		}
+	}
+
+	return undo, nil
+}
+
+// Revert the Update of the block, the outputs it spent come back into the set
+// and the ones it created are removed
+func (u *UTXOSet) Disconnect(block *Block) error {
+	undo, err := u.Blockchain.GetBlockUndo(block)
+	if err != nil {
+		return err
+	}
+
+	view := NewUTXOView(u)
+	if err := view.DisconnectBlock(block, undo); err != nil {
+		return err
+	}
+
+	return u.Blockchain.Store.Update(func(txn StoreTxn) error {
+		return u.writeView(txn, view)
+	})
+}
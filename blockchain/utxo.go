@@ -1,255 +1,261 @@
 package blockchain
 
-import (
-	"bytes"
-	"encoding/hex"
+import "encoding/hex"
 
-	"github.com/dgraph-io/badger"
-)
-
-var (
-	utxoPrefix   = []byte("utxo-")
-	prefixLength = len(utxoPrefix)
-)
+// Flag of the chains whose UTXO set and undo data keep the height of the
+// outputs, the older ones are rebuilt when they are loaded
+const outputHeightsFlag = "outputheights"
 
 type UTXOSet struct {
 	Blockchain *BlockChain
 }
 
-func (u UTXOSet) Reindex() {
-	// open the DB instance from the chain
-	db := u.Blockchain.Database
+// Value of the unspent outputs of a key, the immature ones are coinbase
+// outputs the next block can't spend yet
+type Balance struct {
+	Spendable int
+	Immature  int
+}
 
-	u.DeleteByPrefix(utxoPrefix)
+func (u UTXOSet) Reindex() error {
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
 
-	UTXO := u.Blockchain.FindUTXO()
+	// call a read/write transaction into the store
+	return u.Blockchain.Store.Update(func(txn StoreTxn) error {
+		if err := txn.ClearOutputs(); err != nil {
+			return err
+		}
 
-	// call a read/write transaction into DB
-	err := db.Update(func(txn *badger.Txn) error {
 		for txId, outs := range UTXO {
 			key, err := hex.DecodeString(txId)
 			if err != nil {
 				return err
 			}
 
-			// configure the key with the default prefix
-			key = append(utxoPrefix, key...)
-
-			err = txn.Set(key, outs.Serialize())
-			ErrorHandler(err)
+			if err := txn.PutOutputs(key, outs); err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	ErrorHandler(err)
 }
 
-func (u *UTXOSet) Update(block *Block) {
-	// open the DB instance from the chain
-	db := u.Blockchain.Database
-
-	// call a read/write transaction into DB
-	err := db.Update(func(txn *badger.Txn) error {
-
-		for _, tx := range block.Transactions {
-			if !tx.IsCoinbase() {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-
-					item, err := txn.Get(inID)
-					ErrorHandler(err)
-
-					var dst []byte
-					v, err := item.ValueCopy(dst)
-					ErrorHandler(err)
-					outs := DeserializeOutputs(v)
-
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
-
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							ErrorHandler(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							ErrorHandler(err)
-						}
-					}
-				}
-			}
+func (u *UTXOSet) Update(block *Block) error {
+	view := NewUTXOView(u)
+	undo, err := view.ConnectBlock(block)
+	if err != nil {
+		return err
+	}
 
-			// create a new outputs structure
-			newOutputs := TxOutputs{}
-			newOutputs.Outputs = append(newOutputs.Outputs, tx.Outputs...)
+	// call a read/write transaction into the store
+	return u.Blockchain.Store.Update(func(txn StoreTxn) error {
+		if err := txn.PutUndo(block.Hash, undo); err != nil {
+			return err
+		}
+		return u.writeView(txn, view)
+	})
+}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				ErrorHandler(err)
-			}
+// Write the entries of the view into the set, the fully spent ones are removed
+func (u *UTXOSet) writeView(txn StoreTxn, view *UTXOView) error {
+	for txId, outs := range view.entries {
+		txID, err := hex.DecodeString(txId)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		if len(outs.Outputs) == 0 {
+			err = txn.DeleteOutputs(txID)
+		} else {
+			err = txn.PutOutputs(txID, outs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the unspent outputs of the transaction
+func (u UTXOSet) FindOutputs(txID []byte) (TxOutputs, bool, error) {
+	var outs TxOutputs
+	found := false
+
+	err := u.Blockchain.Store.View(func(txn StoreTxn) (err error) {
+		outs, found, err = txn.GetOutputs(txID)
+		return err
 	})
-	ErrorHandler(err)
+
+	return outs, found, err
 }
 
 // Retreive all transactions without outputs
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
 	var UTXOs []TxOutput
 
-	// get DB instance of the chain
-	db := u.Blockchain.Database
+	// open a readOnly transaction into the store
+	err := u.Blockchain.Store.View(func(txn StoreTxn) error {
+		return txn.ForEachOutputs(func(_ []byte, outs TxOutputs) error {
+			for _, out := range outs.Outputs {
+				if out.IsLockedWithKey(pubKeyHash) {
+					UTXOs = append(UTXOs, out)
+				}
+			}
+			return nil
+		})
+	})
 
-	// open a readOnly transaction into DB
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	return UTXOs, err
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// Get the spendable and the immature value of the unspent outputs of the key
+func (u UTXOSet) GetBalance(pubKeyHash []byte) (Balance, error) {
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return Balance{}, err
+	}
+	return GetBalance(u, pubKeyHash, bestHeight+1, u.Blockchain.Params.CoinbaseMaturity)
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
+// Retreive all the available output transaction for an amount, the immature
+// coinbase outputs are left out
+func (u UTXOSet) FindSpendabaleOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	bestHeight, err := u.Blockchain.GetBestHeight()
+	if err != nil {
+		return 0, nil, err
+	}
+	return FindSpendableOutputs(u, pubKeyHash, amount, bestHeight+1, u.Blockchain.Params.CoinbaseMaturity)
+}
 
-			var dst []byte
-			v, err := item.ValueCopy(dst)
-			ErrorHandler(err)
+// Call fn on the unspent outputs of every transaction
+func (u UTXOSet) ForEachOutputs(fn func(txID []byte, outs TxOutputs) error) error {
+	// open a readOnly transaction into the store
+	return u.Blockchain.Store.View(func(txn StoreTxn) error {
+		return txn.ForEachOutputs(fn)
+	})
+}
 
-			outs := DeserializeOutputs(v)
+// Get the value of the outputs of the set locked with the key, the immature
+// ones can't be spent by a block at the height
+func GetBalance(set OutputSet, pubKeyHash []byte, height, maturity int) (Balance, error) {
+	var balance Balance
 
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+	err := set.ForEachOutputs(func(_ []byte, outs TxOutputs) error {
+		mature := outs.IsMature(height, maturity)
+
+		for _, out := range outs.Outputs {
+			if !out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+			if mature {
+				balance.Spendable += out.Value
+			} else {
+				balance.Immature += out.Value
 			}
 		}
-
 		return nil
 	})
 
-	ErrorHandler(err)
-
-	return UTXOs
+	return balance, err
 }
 
-// Retreive all the available output transaction for an amount
-func (u UTXOSet) FindSpendabaleOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// Pick outputs of the set locked with the key until they hold the amount, a
+// block at the height must be able to spend them
+func FindSpendableOutputs(set OutputSet, pubKeyHash []byte, amount, height, maturity int) (int, map[string][]int, error) {
 	unspentOuts := make(map[string][]int)
 	accumulated := 0
 
-	// get DB instance of the chain
-	db := u.Blockchain.Database
-
-	// open a readOnly transaction into DB
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var dst []byte
-			v, err := item.ValueCopy(dst)
-			ErrorHandler(err)
-			k = bytes.TrimPrefix(k, utxoPrefix)
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				// check if the address is good and add enough coins for the amount
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx)
-				}
-			}
+	err := set.ForEachOutputs(func(ID []byte, outs TxOutputs) error {
+		txID := hex.EncodeToString(ID)
+
+		if !outs.IsMature(height, maturity) {
+			return nil
 		}
 
+		for i, out := range outs.Outputs {
+			// check if the address is good and add enough coins for the amount
+			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
+				accumulated += out.Value
+				unspentOuts[txID] = append(unspentOuts[txID], outs.Indexes[i])
+			}
+		}
 		return nil
 	})
 
-	ErrorHandler(err)
-
-	return accumulated, unspentOuts
+	return accumulated, unspentOuts, err
 }
 
-// make a counter how many transaction unspent into the chain
-func (u UTXOSet) CountTransactions() int {
-	// get DB instance of the chain
-	db := u.Blockchain.Database
+// Get the value of every unspent output
+func (u UTXOSet) TotalValue() (int, error) {
+	total := 0
 
-	counter := 0
+	err := u.Blockchain.Store.View(func(txn StoreTxn) error {
+		return txn.ForEachOutputs(func(_ []byte, outs TxOutputs) error {
+			for _, out := range outs.Outputs {
+				total += out.Value
+			}
+			return nil
+		})
+	})
 
-	// open a readOnly transaction into DB
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	return total, err
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// make a counter how many transaction unspent into the chain
+func (u UTXOSet) CountTransactions() (int, error) {
+	counter := 0
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+	// open a readOnly transaction into the store
+	err := u.Blockchain.Store.View(func(txn StoreTxn) error {
+		return txn.ForEachOutputs(func(_ []byte, _ TxOutputs) error {
 			counter++
-		}
-
-		return nil
+			return nil
+		})
 	})
 
-	ErrorHandler(err)
-
-	return counter
+	return counter, err
 }
 
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
-	// open the read/write transaction to get all the keys need to be delete
-	deleteKeys := func(keysForDelete [][]byte) error {
-		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
-			for _, key := range keysForDelete {
-				if err := txn.Delete(key); err != nil {
-					return err
-				}
-			}
-			return nil
-		}); err != nil {
+// Rebuild the UTXO set and the undo data of the main chain from the genesis
+// block, for the chains stored before the outputs kept their height
+func (chain *BlockChain) rebuildOutputs() error {
+	view := NewUTXOView(nil)
+	iter := chain.ForwardIterator()
+
+	for {
+		block, err := iter.Next()
+		if err != nil {
 			return err
 		}
-		return nil
-	}
+		if block == nil {
+			break
+		}
 
-	collectSize := 100000
-	// iterate into DB with readOnly transaction and loop every 100000 keys
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysForDelete := make([][]byte, 0, collectSize)
-		keyCollected := 0
-
-		// search all the key starting by the prefix
-		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			key := it.Item().KeyCopy(nil)
-			keysForDelete = append(keysForDelete, key)
-			keyCollected++
-			if keyCollected == collectSize {
-				if err := deleteKeys(keysForDelete); err != nil {
-					ErrorHandler(err)
-				}
-				keysForDelete = make([][]byte, 0, collectSize)
-				keyCollected = 0
-			}
+		undo, err := view.ConnectBlock(block)
+		if err != nil {
+			return err
 		}
 
-		if keyCollected > 0 {
-			if err := deleteKeys(keysForDelete); err != nil {
-				ErrorHandler(err)
-			}
+		err = chain.Store.Update(func(txn StoreTxn) error {
+			return txn.PutUndo(block.Hash, undo)
+		})
+		if err != nil {
+			return err
 		}
+	}
 
-		return nil
+	u := UTXOSet{chain}
+
+	return chain.Store.Update(func(txn StoreTxn) error {
+		if err := txn.ClearOutputs(); err != nil {
+			return err
+		}
+		if err := u.writeView(txn, view); err != nil {
+			return err
+		}
+		return txn.SetFlag(outputHeightsFlag)
 	})
 }
@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// Unspent outputs a view is built on, the UTXO set or an overlay of it
+type OutputSet interface {
+	FindOutputs(txID []byte) (TxOutputs, bool, error)
+	ForEachOutputs(fn func(txID []byte, outs TxOutputs) error) error
+}
+
+// In-memory set of unspent outputs on top of the UTXO set, the blocks are
+// connected and disconnected on it before the changes are written back
+type UTXOView struct {
+	set OutputSet
+	// the entries loaded or changed, an entry without outputs is fully spent
+	entries map[string]TxOutputs
+}
+
+func NewUTXOView(set OutputSet) *UTXOView {
+	return &UTXOView{set, make(map[string]TxOutputs)}
+}
+
+// Get the unspent outputs of the transaction, from the UTXO set on first use
+func (view *UTXOView) fetch(txID []byte) (TxOutputs, error) {
+	key := hex.EncodeToString(txID)
+
+	if outs, ok := view.entries[key]; ok {
+		return outs, nil
+	}
+
+	outs := TxOutputs{}
+	if view.set != nil {
+		var err error
+		if outs, _, err = view.set.FindOutputs(txID); err != nil {
+			return TxOutputs{}, err
+		}
+	}
+	view.entries[key] = outs
+
+	return outs, nil
+}
+
+// Get the unspent output created at the index of the transaction
+func (view *UTXOView) FindOutput(txID []byte, index int) (TxOutput, bool, error) {
+	outs, err := view.fetch(txID)
+	if err != nil {
+		return TxOutput{}, false, err
+	}
+	out, found := outs.Find(index)
+	return out, found, nil
+}
+
+// Mark the output created at the index of the transaction as spent
+func (view *UTXOView) SpendOutput(txID []byte, index int) error {
+	outs, err := view.fetch(txID)
+	if err != nil {
+		return err
+	}
+	view.entries[hex.EncodeToString(txID)] = outs.Remove(index)
+	return nil
+}
+
+// Spend the inputs of the transaction of the block at the height and add its
+// outputs, the spent outputs are returned in the order of the inputs
+func (view *UTXOView) ConnectTransaction(tx *Transaction, height int) ([]SpentOutput, error) {
+	var spent []SpentOutput
+
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			outs, err := view.fetch(in.ID)
+			if err != nil {
+				return nil, err
+			}
+			out, _ := outs.Find(in.Index())
+			spent = append(spent, SpentOutput{out, outs.Height, outs.Coinbase})
+			if err := view.SpendOutput(in.ID, in.Index()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	outs := TxOutputs{Height: height, Coinbase: tx.IsCoinbase()}
+	for outIdx, out := range tx.Outputs {
+		outs.Add(outIdx, out)
+	}
+	view.entries[hex.EncodeToString(tx.ID)] = outs
+
+	return spent, nil
+}
+
+// Spend the inputs of the block and add its outputs, the undo data holds
+// everything needed to disconnect it
+func (view *UTXOView) ConnectBlock(block *Block) (*BlockUndo, error) {
+	undo := &BlockUndo{}
+	for _, tx := range block.Transactions {
+		spent, err := view.ConnectTransaction(tx, block.Height)
+		if err != nil {
+			return nil, err
+		}
+		undo.Spent = append(undo.Spent, spent...)
+	}
+	return undo, nil
+}
+
+// Revert a connected block with the outputs its inputs spent
+func (view *UTXOView) DisconnectBlock(block *Block, undo *BlockUndo) error {
+	next := len(undo.Spent)
+
+	// undo the transactions from the last one, a transaction can spend
+	// the outputs of a previous one into the same block
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		view.entries[hex.EncodeToString(tx.ID)] = TxOutputs{}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		next -= len(tx.Inputs)
+		if next < 0 {
+			return fmt.Errorf("%w: block %x", ErrBadUndo, block.Hash)
+		}
+
+		for inIdx, in := range tx.Inputs {
+			outs, err := view.fetch(in.ID)
+			if err != nil {
+				return err
+			}
+			spent := undo.Spent[next+inIdx]
+			outs.Add(in.Index(), spent.TxOutput)
+			outs.Height = spent.Height
+			outs.Coinbase = spent.Coinbase
+			view.entries[hex.EncodeToString(in.ID)] = outs
+		}
+	}
+
+	if next != 0 {
+		return fmt.Errorf("%w: block %x", ErrBadUndo, block.Hash)
+	}
+
+	return nil
+}
@@ -0,0 +1,438 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	// max number of seconds a block timestamp can be ahead of the local clock
+	maxFutureBlockTime = 2 * 60 * 60
+	// number of previous blocks used to compute the median time past
+	medianTimeBlocks = 11
+)
+
+// Consensus limits of the serialized size of the blocks and the transactions,
+// and of the number of inputs and outputs of a transaction
+const (
+	MaxBlockSize = 1000000
+	MaxTxSize    = 100000
+	MaxTxInputs  = 500
+	MaxTxOutputs = 2000
+)
+
+// Reasons for a block to be rejected, check them with errors.Is
+var (
+	ErrBlockExists    = errors.New("Block already exists")
+	ErrMissingParent  = errors.New("Previous block is not found")
+	ErrBadHeight      = errors.New("Block height doesn't follow its parent")
+	ErrBadDifficulty  = errors.New("Block difficulty doesn't match the retarget schedule")
+	ErrBadProofOfWork = errors.New("Block hash doesn't meet its difficulty")
+	ErrBadBlockHash   = errors.New("Block hash doesn't match its header")
+	ErrBadMerkleRoot  = errors.New("Block Merkle root doesn't match its transactions")
+	ErrBadTimestamp   = errors.New("Block timestamp is out of range")
+	ErrNoTransactions = errors.New("Block has no transaction")
+	ErrBadCoinbase    = errors.New("Block coinbase is not valid")
+	ErrCoinbaseHeight = errors.New("Block coinbase doesn't commit to the block height")
+	ErrBadTransaction = errors.New("Transaction is malformed")
+	ErrBadTxID        = errors.New("Transaction ID doesn't match its hash")
+	ErrDuplicateTx    = errors.New("Transaction is twice into the block")
+	ErrMissingInput   = errors.New("Transaction input is not an unspent output")
+	ErrDoubleSpend    = errors.New("Output is spent twice")
+	ErrBadSignature   = errors.New("Transaction signature is not valid")
+	ErrSpendTooHigh   = errors.New("Transaction spends more than its inputs")
+	ErrImmatureSpend  = errors.New("Transaction spends an immature coinbase")
+	ErrOverwriteTx    = errors.New("Transaction ID is the one of unspent outputs")
+	ErrBlockTooBig    = errors.New("Block is larger than the maximum size")
+	ErrTxTooBig       = errors.New("Transaction is larger than the maximum size")
+	ErrTooManyInputs  = errors.New("Transaction has too many inputs")
+	ErrTooManyOutputs = errors.New("Transaction has too many outputs")
+	ErrBadValue       = errors.New("Transaction output value is out of range")
+)
+
+// Error returned when a block or a transaction breaks a consensus rule,
+// Err is one of the sentinel errors above
+type RuleError struct {
+	Err         error
+	Description string
+}
+
+func (e RuleError) Error() string {
+	return e.Description
+}
+
+func (e RuleError) Unwrap() error {
+	return e.Err
+}
+
+func ruleError(err error, format string, args ...interface{}) error {
+	return RuleError{err, fmt.Sprintf("%s: %s", err, fmt.Sprintf(format, args...))}
+}
+
+// Run every consensus rule on a block before it can be stored into the chain.
+// The transactions are checked against the branch the block extends once the
+// branch holds more work than the main chain.
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	chain.lock.Lock()
+	defer chain.lock.Unlock()
+
+	_, _, err := chain.validateBlock(block)
+	return err
+}
+
+// Validate the block and plan the move of the tip onto it, the plan is nil
+// while the branch of the block holds less work than the main chain. The work
+// is the one of the chain ending with the block.
+func (chain *BlockChain) validateBlock(block *Block) (*chainSwitch, *big.Int, error) {
+	if chain.HasBlock(block.Hash) {
+		return nil, nil, ruleError(ErrBlockExists, "block %x", block.Hash)
+	}
+
+	if err := CheckBlockSanity(block, chain.Params.MaxMoney()); err != nil {
+		return nil, nil, err
+	}
+
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return nil, nil, ruleError(ErrMissingParent, "block %x has the parent %x", block.Hash, block.PrevHash)
+	}
+
+	if err := chain.checkBlockContext(block, &parent); err != nil {
+		return nil, nil, err
+	}
+
+	work, err := chain.GetChainWork(block.PrevHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	work.Add(work, BlockWork(block.Bits))
+
+	tipWork, err := chain.GetChainWork(chain.LastHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the block is stored unconnected on its side branch, its transactions
+	// are checked when the branch takes over the main chain
+	if work.Cmp(tipWork) <= 0 {
+		return nil, work, nil
+	}
+
+	sw, err := chain.switchTo(&parent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	undo, err := chain.checkBlockTransactions(block, sw.view)
+	if err != nil {
+		return nil, nil, err
+	}
+	sw.attach = append(sw.attach, block)
+	sw.undo = append(sw.undo, undo)
+
+	return sw, work, nil
+}
+
+// Check the rules which don't depend on the rest of the chain, no output of
+// the block can hold more than the max money
+func CheckBlockSanity(block *Block, maxMoney int) error {
+	if len(block.Transactions) == 0 {
+		return ruleError(ErrNoTransactions, "block %x", block.Hash)
+	}
+
+	if size := len(block.Serialize()); size > MaxBlockSize {
+		return ruleError(ErrBlockTooBig, "block %x has %d bytes, the maximum is %d", block.Hash, size, MaxBlockSize)
+	}
+
+	if !bytes.Equal(block.Hash, block.ComputeHash()) {
+		return ruleError(ErrBadBlockHash, "block %x", block.Hash)
+	}
+
+	if !NewProof(block).Validate() {
+		return ruleError(ErrBadProofOfWork, "block %x with difficulty %d", block.Hash, block.Bits)
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTransaction()) {
+		return ruleError(ErrBadMerkleRoot, "block %x", block.Hash)
+	}
+
+	if block.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return ruleError(ErrBadTimestamp, "block %x is too far in the future", block.Hash)
+	}
+
+	if !block.Transactions[0].IsCoinbase() {
+		return ruleError(ErrBadCoinbase, "first transaction of block %x isn't a coinbase", block.Hash)
+	}
+
+	if height, ok := block.Transactions[0].CoinbaseHeight(); !ok || height != block.Height {
+		return ruleError(ErrCoinbaseHeight, "coinbase of block %x at height %d", block.Hash, block.Height)
+	}
+
+	spent := make(map[string]bool)
+	txIDs := make(map[string]bool)
+
+	for i, tx := range block.Transactions {
+		if i > 0 && tx.IsCoinbase() {
+			return ruleError(ErrBadCoinbase, "block %x has more than one coinbase", block.Hash)
+		}
+
+		if err := CheckTransactionSanity(tx, maxMoney); err != nil {
+			return err
+		}
+
+		// a copy of a transaction can be added without changing the root of a tree
+		// which duplicates the odd nodes, it is rejected whatever the tree
+		if txIDs[string(tx.ID)] {
+			return ruleError(ErrDuplicateTx, "transaction %x into block %x", tx.ID, block.Hash)
+		}
+		txIDs[string(tx.ID)] = true
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		// the same output can't be spent twice into the block
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Index())
+			if spent[outpoint] {
+				return ruleError(ErrDoubleSpend, "output %s into block %x", outpoint, block.Hash)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+// Check the rules of a transaction which don't depend on the chain, its
+// outputs can't hold more than the max money together
+func CheckTransactionSanity(tx *Transaction, maxMoney int) error {
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return ruleError(ErrBadTransaction, "transaction %x needs inputs and outputs", tx.ID)
+	}
+
+	if len(tx.Inputs) > MaxTxInputs {
+		return ruleError(ErrTooManyInputs, "transaction %x has %d inputs, the maximum is %d", tx.ID, len(tx.Inputs), MaxTxInputs)
+	}
+	if len(tx.Outputs) > MaxTxOutputs {
+		return ruleError(ErrTooManyOutputs, "transaction %x has %d outputs, the maximum is %d", tx.ID, len(tx.Outputs), MaxTxOutputs)
+	}
+	if size := tx.Size(); size > MaxTxSize {
+		return ruleError(ErrTxTooBig, "transaction %x has %d bytes, the maximum is %d", tx.ID, size, MaxTxSize)
+	}
+
+	// the inputs are checked one by one against the outputs, an output spent
+	// by two inputs would be counted twice
+	spent := make(map[string]bool)
+	for i, in := range tx.Inputs {
+		// an input is final or replaceable, the other sequences are left to
+		// later rules
+		if !tx.IsCoinbase() && (in.Out < 0 || in.Sequence() > SequenceReplaceable) {
+			return ruleError(ErrBadTransaction, "input %d of transaction %x has the sequence %d", i, tx.ID, in.Sequence())
+		}
+
+		outpoint := fmt.Sprintf("%x:%d", in.ID, in.Index())
+		if spent[outpoint] {
+			return ruleError(ErrDoubleSpend, "output %s twice into transaction %x", outpoint, tx.ID)
+		}
+		spent[outpoint] = true
+	}
+
+	// the total is checked against the max money before each sum, so it
+	// can't overflow
+	total := 0
+	for i, out := range tx.Outputs {
+		if out.Value < 0 {
+			return ruleError(ErrBadValue, "output %d of transaction %x holds %d", i, tx.ID, out.Value)
+		}
+		if out.Value > maxMoney-total {
+			return ruleError(ErrBadValue, "outputs of transaction %x hold more than %d", tx.ID, maxMoney)
+		}
+		total += out.Value
+	}
+
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return ruleError(ErrBadTxID, "transaction %x", tx.ID)
+	}
+
+	return nil
+}
+
+// Check the block against its parent
+func (chain *BlockChain) checkBlockContext(block, parent *Block) error {
+	return chain.checkHeaderContext(&block.BlockHeader, block.Hash, &parent.BlockHeader)
+}
+
+// Check the header of the block with the hash against the header of its
+// parent, the body isn't needed
+func (chain *BlockChain) checkHeaderContext(header *BlockHeader, hash []byte, parent *BlockHeader) error {
+	if header.Height != parent.Height+1 {
+		return ruleError(ErrBadHeight, "block %x has height %d, its parent %d", hash, header.Height, parent.Height)
+	}
+
+	expected, err := chain.NextDifficulty(parent)
+	if err != nil {
+		return err
+	}
+	if header.Bits != expected {
+		return ruleError(ErrBadDifficulty, "block %x claims %d, expected %d", hash, header.Bits, expected)
+	}
+
+	medianTime, err := chain.medianTimePast(parent)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp < medianTime {
+		return ruleError(ErrBadTimestamp, "block %x is before the median time %d", hash, medianTime)
+	}
+
+	return nil
+}
+
+// Get the median timestamp of the last blocks ending with the block
+func (chain *BlockChain) medianTimePast(header *BlockHeader) (int64, error) {
+	var timestamps []int64
+
+	for {
+		timestamps = append(timestamps, header.Timestamp)
+
+		if len(timestamps) == medianTimeBlocks || len(header.PrevHash) == 0 {
+			break
+		}
+
+		prev, err := chain.GetHeader(header.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+		header = &prev
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+// Check and apply the transactions of the block on the view in their order
+func (chain *BlockChain) checkBlockTransactions(block *Block, view *UTXOView) (*BlockUndo, error) {
+	undo := &BlockUndo{}
+	fees := 0
+
+	for _, tx := range block.Transactions {
+		// the outputs of a transaction with the ID of unspent ones would
+		// replace them into the set
+		if err := checkTxIDUnused(tx, view); err != nil {
+			return nil, err
+		}
+
+		if !tx.IsCoinbase() {
+			fee, err := CheckTransactionInputs(tx, view, block.Height, chain.Params.CoinbaseMaturity)
+			if err != nil {
+				return nil, err
+			}
+			fees += fee
+		}
+
+		spent, err := view.ConnectTransaction(tx, block.Height)
+		if err != nil {
+			return nil, err
+		}
+		undo.Spent = append(undo.Spent, spent...)
+	}
+
+	// the coinbase collects the fees of the block on top of the subsidy
+	value := 0
+	for _, out := range block.Transactions[0].Outputs {
+		value += out.Value
+	}
+	subsidy := chain.Params.Subsidy(block.Height)
+	if value > subsidy+fees {
+		return nil, ruleError(ErrBadCoinbase, "coinbase of block %x pays %d, the subsidy is %d with %d of fees", block.Hash, value, subsidy, fees)
+	}
+
+	return undo, nil
+}
+
+// Check that no unspent output of the view was created by a transaction with
+// the ID of the transaction
+func checkTxIDUnused(tx *Transaction, view *UTXOView) error {
+	outs, err := view.fetch(tx.ID)
+	if err != nil {
+		return err
+	}
+	if len(outs.Outputs) > 0 {
+		return ruleError(ErrOverwriteTx, "transaction %x", tx.ID)
+	}
+	return nil
+}
+
+// Check that the inputs of the transaction spend unspent outputs of the view
+// with valid signatures, and that it doesn't create more than it spends. The
+// transaction goes into a block at the height, the coinbase outputs it spends
+// need the maturity. The difference is the fee of the transaction.
+func CheckTransactionInputs(tx *Transaction, view *UTXOView, height, maturity int) (int, error) {
+	prevOuts := make([]TxOutput, len(tx.Inputs))
+	inTotal := 0
+
+	for i, in := range tx.Inputs {
+		outs, err := view.fetch(in.ID)
+		if err != nil {
+			return 0, err
+		}
+		out, ok := outs.Find(in.Index())
+		if !ok {
+			return 0, ruleError(ErrMissingInput, "transaction %x spends %x:%d", tx.ID, in.ID, in.Index())
+		}
+		if !outs.IsMature(height, maturity) {
+			return 0, ruleError(ErrImmatureSpend, "transaction %x spends %x:%d from height %d at height %d", tx.ID, in.ID, in.Index(), outs.Height, height)
+		}
+		prevOuts[i] = out
+		inTotal += out.Value
+	}
+
+	if !tx.VerifyOutputs(prevOuts) {
+		return 0, ruleError(ErrBadSignature, "transaction %x", tx.ID)
+	}
+
+	outTotal := 0
+	for _, out := range tx.Outputs {
+		outTotal += out.Value
+	}
+	if outTotal > inTotal {
+		return 0, ruleError(ErrSpendTooHigh, "transaction %x spends %d, its inputs hold %d", tx.ID, outTotal, inTotal)
+	}
+
+	return inTotal - outTotal, nil
+}
+
+// Check a transaction for the memory pool, it must be valid into the next
+// block on top of the tip. Returns the fee of the transaction.
+func (chain *BlockChain) CheckMempoolTransaction(tx *Transaction) (int, error) {
+	return chain.CheckMempoolTransactionView(tx, NewUTXOView(&UTXOSet{chain}))
+}
+
+// Check a transaction for the memory pool against the view, a view on an
+// overlay of the UTXO set lets it spend the outputs of the memory pool
+func (chain *BlockChain) CheckMempoolTransactionView(tx *Transaction, view *UTXOView) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, ruleError(ErrBadCoinbase, "transaction %x is a coinbase out of a block", tx.ID)
+	}
+
+	if err := CheckTransactionSanity(tx, chain.Params.MaxMoney()); err != nil {
+		return 0, err
+	}
+
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := checkTxIDUnused(tx, view); err != nil {
+		return 0, err
+	}
+
+	return CheckTransactionInputs(tx, view, bestHeight+1, chain.Params.CoinbaseMaturity)
+}
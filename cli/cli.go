@@ -1,52 +1,83 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/savecomdev/blockchain-pow-go/blockchain"
+	"github.com/savecomdev/blockchain-pow-go/mempool"
 	"github.com/savecomdev/blockchain-pow-go/network"
 	"github.com/savecomdev/blockchain-pow-go/wallet"
 )
 
-type CommandLine struct{}
+// the usage is already printed for the wrong commands
+var errUsage = errors.New("Invalid command")
+
+type CommandLine struct {
+	params *blockchain.ChainParams
+}
 
 func (cli *CommandLine) printUsage() {
+	fmt.Println("Usage : [-network NETWORK] [-config FILE] [-datadir DIR] [-reward REWARD] [-difficulty DIFFICULTY] [-magic MAGIC] [-peers HOST:PORT,...] COMMAND")
+	fmt.Println("--> The network is mainnet, testnet or regtest, the JSON config file overrides its parameters and the flags override the file")
+	fmt.Println("--> A coinbase is spent 100 blocks after its own on mainnet and testnet, and on the next block on regtest: send from the address of createblockchain with -network regtest")
 	fmt.Println("Usage commandes :")
 	fmt.Println("--> To get the balance for the account: \ngetbalance -address ADDRESS")
 	fmt.Println("--> To create a chain: \ncreateblockchain -address ADDRESS")
 	fmt.Println("--> To prints the blocks in the chain: \nprintchain")
-	fmt.Println("--> To send amount from account to another into the chain. The -mine flag indicate that node mining kind:	\nsend -from FROM -to TO -amount AMOUNT -mine")
+	fmt.Println("--> To send amount from account to another into the chain. The -mine flag indicate that node mining kind, without it the change of the sent transactions can be spent before they are mined. The -rbf flag lets bumpfee replace the transaction:	\nsend -from FROM -to TO -amount AMOUNT -fee FEE -mine -rbf")
+	fmt.Println("--> To pay a higher fee for a sent transaction, taken on its change, when it was sent with -rbf: \nbumpfee -txid TXID -fee FEE")
 	fmt.Println("--> To creates a new wallet: \ncreatewallet")
 	fmt.Println("--> To list the addresses in our waller file: \nlistaddresses")
 	fmt.Println("--> To rebuild the UTXO set: \nreindexutxo")
-	fmt.Println("--> To start a node with ID specified in NODE_ID env. var. -miner enables mining: \nstartnode -miner ADDRESS")
+	fmt.Println("--> To build the transaction index and keep it up to date: \nindextx")
+	fmt.Println("--> To print a transaction of the chain with its confirmations: \ngettransaction -txid TXID")
+	fmt.Println("--> To print the proof that a transaction sits into its block: \ngettxproof -txid TXID")
+	fmt.Println("--> To check a proof printed by gettxproof, without the chain: \nverifytxproof -proof PROOF")
+	fmt.Println("--> To print the supply issued up to a height, the tip by default: \ngetsupply -height HEIGHT")
+	fmt.Println("--> To build the address index and keep it up to date: \nindexaddr")
+	fmt.Println("--> To print the transactions of an address, -skip and -count select a page: \ngethistory -address ADDRESS -skip SKIP -count COUNT")
+	fmt.Println("--> To start a node with ID specified in NODE_ID env. var. -miner enables mining: \nstartnode -miner ADDRESS [-workers N]")
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) error {
+	if len(args) < 1 {
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
+	return nil
 }
 
-func (cli *CommandLine) printChain(nodeID string) {
-	chain := blockchain.CountinueBlockChain(nodeID)
-	defer chain.Database.Close()
+func (cli *CommandLine) printChain(nodeID string) error {
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
 
 	// get the iterator into the chain
 	iter := chain.Iterator()
 
 	// iterate loop
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
 
 		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
 		fmt.Printf("Hash: %x\n", block.Hash)
+		fmt.Printf("Merkle Root: %x\n", block.MerkleRoot)
+		fmt.Printf("Height: %d\n", block.Height)
+		fmt.Printf("Difficulty: %d\n", block.Bits)
 
 		pow := blockchain.NewProof(block)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
@@ -62,136 +93,507 @@ func (cli *CommandLine) printChain(nodeID string) {
 			break
 		}
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createBlockChain(address, nodeID string) {
+func (cli *CommandLine) createBlockChain(address, nodeID string) error {
 	if !wallet.ValidateAddress(address) {
-		log.Panic("Address isn't valid !!!")
+		return fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, address)
 	}
 
-	chain := blockchain.InitBlockChain(address, nodeID)
-	chain.Database.Close()
-
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	chain, err := blockchain.InitBlockChain(cli.params, address, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
 
+	fmt.Printf("Genesis block %x\n", chain.GetLastHash())
 	fmt.Println("Finished !!!")
+
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address, nodeID string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address isn't valid !!!")
+// Print the hash of a mined block with the hashrate it took
+func printMined(block *blockchain.Block, pow *blockchain.ProofOfWork) {
+	fmt.Printf("%x\n", block.Hash)
+	fmt.Printf("%d hashes in %s, %.0f H/s\n", pow.Hashes, pow.Elapsed.Round(time.Millisecond), pow.HashRate())
+}
+
+func (cli *CommandLine) getBalance(address, nodeID string) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		return err
 	}
 
 	// open the current chain
-	chain := blockchain.CountinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
-	defer chain.Database.Close()
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	balance, err := UTXOSet.GetBalance(pubKeyHash)
+	if err != nil {
+		return err
+	}
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	fmt.Printf("Balance of %s: %d\n", address, balance.Spendable)
+	if balance.Immature > 0 {
+		fmt.Printf("Immature: %d, spendable after %d confirmations\n", balance.Immature, cli.params.CoinbaseMaturity)
 	}
 
-	fmt.Printf("Balance of %s: %d\n", address, balance)
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CommandLine) send(from, to string, amount, fee int, nodeID string, mineNow, replaceable bool) error {
 	if !wallet.ValidateAddress(from) {
-		log.Panic("Address isn't valid !!!")
+		return fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, from)
 	}
 	if !wallet.ValidateAddress(to) {
-		log.Panic("Address isn't valid !!!")
+		return fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, to)
 	}
 
 	// open the current chain
-	chain := blockchain.CountinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
-	defer chain.Database.Close()
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Close()
 
-	wallets, err := wallet.CreateWallets(nodeID)
-	blockchain.ErrorHandler(err)
-	wallet := wallets.GetWallet(from)
+	wallets, err := wallet.CreateWallets(cli.params.WalletPath(nodeID))
+	if err != nil {
+		return err
+	}
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		return err
+	}
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
+	// the block mined here holds the transaction alone, a transaction sent
+	// to the network can spend the change of the sent ones still waiting
+	var outputs blockchain.OutputSet = &UTXOSet
+	if !mineNow {
+		outputs = sentPool(chain, wallets).Overlay()
+	}
+
+	tx, err := blockchain.NewTransactionFrom(&wallet, to, amount, fee, replaceable, chain, outputs)
+	if err != nil {
+		return err
+	}
 	if mineNow {
-		cbTx := blockchain.CoinBaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
+		bestHeight, err := chain.GetBestHeight()
+		if err != nil {
+			return err
+		}
 
+		// the fee comes back to the sender who mines the block
+		cbTx, err := blockchain.CoinBaseTx(from, "", bestHeight+1, cli.params.Subsidy(bestHeight+1)+fee)
+		if err != nil {
+			return err
+		}
+		txs := []*blockchain.Transaction{cbTx, tx}
+		block, pow, err := chain.MineBlockContext(context.Background(), txs, 0)
+		if err != nil {
+			return err
+		}
+		printMined(block, pow)
 	} else {
-		network.SendTransaction(network.KnownNodes[0], tx)
-		fmt.Println("Send transaction")
+		if err := network.SendTransaction(network.KnownNodes[0], tx); err != nil {
+			return err
+		}
+		fmt.Printf("Send transaction %x\n", tx.ID)
+
+		// keep it to bump its fee
+		wallets.AddSent(hex.EncodeToString(tx.ID), tx.Serialize())
+		if err := wallets.SaveIntoFile(cli.params.WalletPath(nodeID)); err != nil {
+			return err
+		}
 	}
 
 	fmt.Println("Sending with success !!!")
+
+	return nil
+}
+
+// Get the memory pool of the transactions sent by the wallets which aren't
+// into a block yet. The ones the chain holds are dropped from the wallets
+// without being replayed, found through the transaction index when the chain
+// keeps one, and so are the ones the pool refuses, like the ones spending an
+// output the chain spent. A transaction can come before its parent, it waits
+// as an orphan until its parent is replayed.
+func sentPool(chain *blockchain.BlockChain, wallets *wallet.Wallets) *mempool.Pool {
+	pool := mempool.New(chain, mempool.DefaultPolicy)
+
+	for txID, data := range wallets.Sent {
+		tx, err := blockchain.DeserializeTransaction(data)
+		if err != nil {
+			wallets.RemoveSent(txID)
+			continue
+		}
+		if _, err := chain.FindTransaction(tx.ID); err == nil {
+			wallets.RemoveSent(txID)
+			continue
+		}
+		pool.Accept(&tx)
+	}
+
+	for txID := range wallets.Sent {
+		ID, err := hex.DecodeString(txID)
+		if err != nil || !pool.Has(ID) {
+			wallets.RemoveSent(txID)
+		}
+	}
+
+	return pool
+}
+
+func (cli *CommandLine) bumpFee(txID string, fee int, nodeID string) error {
+	wallets, err := wallet.CreateWallets(cli.params.WalletPath(nodeID))
+	if err != nil {
+		return err
+	}
+
+	data, err := wallets.GetSent(txID)
+	if err != nil {
+		return err
+	}
+	tx, err := blockchain.DeserializeTransaction(data)
+	if err != nil {
+		return err
+	}
+
+	// the wallet which signed the inputs
+	var w *wallet.Wallet
+	for _, candidate := range wallets.Wallets {
+		if len(tx.Inputs) > 0 && bytes.Equal(candidate.PublicKey, tx.Inputs[0].PubKey) {
+			w = candidate
+		}
+	}
+	if w == nil {
+		return fmt.Errorf("%w: signing %s", wallet.ErrWalletNotFound, txID)
+	}
+
+	newTx, err := blockchain.BumpFee(w, &tx, fee)
+	if err != nil {
+		return err
+	}
+
+	if err := network.SendTransaction(network.KnownNodes[0], newTx); err != nil {
+		return err
+	}
+	fmt.Printf("Send transaction %x replacing %s\n", newTx.ID, txID)
+
+	wallets.RemoveSent(txID)
+	wallets.AddSent(hex.EncodeToString(newTx.ID), newTx.Serialize())
+
+	return wallets.SaveIntoFile(cli.params.WalletPath(nodeID))
 }
 
-func (cli *CommandLine) listAddresses(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
+func (cli *CommandLine) listAddresses(nodeID string) error {
+	wallets, err := wallet.CreateWallets(cli.params.WalletPath(nodeID))
+	if err != nil {
+		return err
+	}
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createWallet(nodeID string) {
-	wallets, _ := wallet.CreateWallets(nodeID)
-	address := wallets.AddWallet()
+func (cli *CommandLine) createWallet(nodeID string) error {
+	// the wallets file doesn't exist before the first wallet
+	wallets, err := wallet.CreateWallets(cli.params.WalletPath(nodeID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	address, err := wallets.AddWallet()
+	if err != nil {
+		return err
+	}
 
-	wallets.SaveIntoFile(nodeID)
+	if err := wallets.SaveIntoFile(cli.params.WalletPath(nodeID)); err != nil {
+		return err
+	}
 	fmt.Printf("Create new wallet with address: %s\n", address)
+
+	return nil
 }
 
-func (cli *CommandLine) reindexUTXO(nodeID string) {
-	chain := blockchain.CountinueBlockChain(nodeID)
-	defer chain.Database.Close()
+func (cli *CommandLine) reindexUTXO(nodeID string) error {
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
 
-	count := UTXOSet.CountTransactions()
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Done! There are %d transactions in the UTXOset.\n", count)
+
+	return nil
 }
 
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+func (cli *CommandLine) indexTransactions(nodeID string) error {
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	if err := chain.EnableTxIndex(); err != nil {
+		return err
+	}
+
+	fmt.Println("Done! The transaction index is up to date.")
+
+	return nil
+}
+
+func (cli *CommandLine) getTransaction(txID, nodeID string) error {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	info, err := chain.GetTransaction(ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x\n", info.BlockHash)
+	fmt.Printf("Height: %d\n", info.Height)
+	fmt.Printf("Confirmations: %d\n", info.Confirmations)
+	fmt.Println(info.Transaction)
+
+	return nil
+}
+
+func (cli *CommandLine) getTxProof(txID, nodeID string) error {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	proof, err := chain.GetTxProof(ID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x\n", proof.BlockHash())
+	fmt.Printf("Merkle Root: %x\n", proof.Header.MerkleRoot)
+	fmt.Printf("Index: %d\n", proof.Proof.Index)
+	for _, hash := range proof.Proof.Hashes {
+		fmt.Printf("  %x\n", hash)
+	}
+	fmt.Printf("Proof: %x\n", proof.Serialize())
+
+	return nil
+}
+
+func (cli *CommandLine) verifyTxProof(proofHex string) error {
+	data, err := hex.DecodeString(proofHex)
+	if err != nil {
+		return err
+	}
+
+	proof, err := blockchain.DeserializeTxProof(data)
+	if err != nil {
+		return err
+	}
+
+	if !proof.Verify() {
+		return fmt.Errorf("Invalid proof of transaction %x", proof.TxID)
+	}
+
+	fmt.Printf("Transaction %x sits into block %x at height %d\n", proof.TxID, proof.BlockHash(), proof.Header.Height)
+	fmt.Printf("The header isn't checked against any chain, it only holds the work of the difficulty %d it claims\n", proof.Header.Bits)
+
+	return nil
+}
+
+func (cli *CommandLine) getSupply(height int, nodeID string) error {
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	if height < 0 {
+		if height, err = chain.GetBestHeight(); err != nil {
+			return err
+		}
+	}
+
+	supply, err := chain.GetSupply(height)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Height: %d\n", supply.Height)
+	fmt.Printf("Subsidy: %d\n", cli.params.Subsidy(supply.Height))
+	fmt.Printf("Issued: %d\n", supply.Issued)
+	fmt.Printf("Scheduled: %d\n", supply.Scheduled)
+	if supply.Unspent >= 0 {
+		fmt.Printf("Unspent: %d\n", supply.Unspent)
+	}
+	if max := cli.params.MaxSupply(); max >= 0 {
+		fmt.Printf("Max supply: %d\n", max)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) indexAddresses(nodeID string) error {
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	if err := chain.EnableAddrIndex(); err != nil {
+		return err
+	}
+
+	fmt.Println("Done! The address index is up to date.")
+
+	return nil
+}
+
+func (cli *CommandLine) getHistory(address string, skip, count int, nodeID string) error {
+	pubKeyHash, err := wallet.AddressToPubKeyHash(address)
+	if err != nil {
+		return err
+	}
+
+	chain, err := blockchain.CountinueBlockChain(cli.params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	history, err := chain.GetAddressHistory(pubKeyHash, skip, count)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("History of %s:\n", address)
+	for _, entry := range history {
+		fmt.Printf("Height: %d TX: %x Received: %d Sent: %d Balance: %d\n",
+			entry.Height, entry.TxID, entry.Received, entry.Sent, entry.Balance)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) StartNode(nodeID, minerAddress string) error {
 	fmt.Printf("Starting Node %s\n", nodeID)
 
 	if len(minerAddress) > 0 {
-		if wallet.ValidateAddress(minerAddress) {
-			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
-		} else {
-			log.Panic("Wrong miner address!")
+		if !wallet.ValidateAddress(minerAddress) {
+			return fmt.Errorf("Wrong miner address: %w", wallet.ErrInvalidAddress)
 		}
+		fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
 	}
-	network.StartServer(nodeID, minerAddress)
+
+	return network.StartServer(nodeID, minerAddress)
 }
 
 // main function of the cli
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+func (cli *CommandLine) Run() error {
+	// the global flags come before the command
+	globalCmd := flag.NewFlagSet("blockchain", flag.ContinueOnError)
+	networkName := globalCmd.String("network", blockchain.MainNetParams.Name, "The network to run: mainnet, testnet or regtest")
+	configFile := globalCmd.String("config", "", "The JSON file overriding the parameters of the network")
+	dataDir := globalCmd.String("datadir", "", "The directory of the data of the nodes")
+	reward := globalCmd.Int("reward", 0, "The subsidy of the first blocks")
+	difficulty := globalCmd.Int("difficulty", 0, "The difficulty of the genesis block")
+	magic := globalCmd.String("magic", "", "The first bytes of the messages, as 0xb10c0001")
+	peers := globalCmd.String("peers", "", "The nodes known at start separated by commas, the first one is the central node")
+
+	if err := globalCmd.Parse(os.Args[1:]); err != nil {
+		return err
+	}
+	args := globalCmd.Args()
+
+	if err := cli.validateArgs(args); err != nil {
+		return err
+	}
+
+	// only the flags given override the network and the config file
+	params, err := blockchain.LoadParams(*networkName, *configFile, func(params *blockchain.ChainParams) (err error) {
+		globalCmd.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "datadir":
+				params.DataDir = *dataDir
+			case "reward":
+				params.Reward = *reward
+			case "difficulty":
+				params.InitialDifficulty = *difficulty
+			case "magic":
+				value, parseErr := strconv.ParseUint(*magic, 0, 32)
+				if parseErr != nil {
+					err = fmt.Errorf("Invalid magic %s: %w", *magic, parseErr)
+				}
+				params.Magic = uint32(value)
+			case "peers":
+				params.DefaultPeers = strings.Split(*peers, ",")
+			}
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	cli.params = params
+	network.Setup(params)
 
 	nodeID := os.Getenv("NODE_ID")
 	if nodeID == "" {
-		fmt.Printf("NODE_ID env is not set !")
-		runtime.Goexit()
+		return errors.New("NODE_ID env is not set !")
 	}
 
 	// cmd
-	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
-	createBlockChainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
-	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
-	createwalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
-	listaddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
-	reindexutxoCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
-	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ContinueOnError)
+	createBlockChainCmd := flag.NewFlagSet("createblockchain", flag.ContinueOnError)
+	sendCmd := flag.NewFlagSet("send", flag.ContinueOnError)
+	bumpFeeCmd := flag.NewFlagSet("bumpfee", flag.ContinueOnError)
+	printChainCmd := flag.NewFlagSet("printchain", flag.ContinueOnError)
+	createwalletCmd := flag.NewFlagSet("createwallet", flag.ContinueOnError)
+	listaddressesCmd := flag.NewFlagSet("listaddresses", flag.ContinueOnError)
+	reindexutxoCmd := flag.NewFlagSet("reindexutxo", flag.ContinueOnError)
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ContinueOnError)
+	indextxCmd := flag.NewFlagSet("indextx", flag.ContinueOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ContinueOnError)
+	getTxProofCmd := flag.NewFlagSet("gettxproof", flag.ContinueOnError)
+	verifyTxProofCmd := flag.NewFlagSet("verifytxproof", flag.ContinueOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ContinueOnError)
+	indexaddrCmd := flag.NewFlagSet("indexaddr", flag.ContinueOnError)
+	getHistoryCmd := flag.NewFlagSet("gethistory", flag.ContinueOnError)
 
 	// data
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address of the wallet")
@@ -199,87 +601,194 @@ func (cli *CommandLine) Run() {
 	sendFrom := sendCmd.String("from", "", "The source wallet address")
 	sendTo := sendCmd.String("to", "", "The destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "The amount to send, must be upper than 0 value")
+	sendFee := sendCmd.Int("fee", 0, "The fee left to the miner, on top of the amount")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	sendRBF := sendCmd.Bool("rbf", false, "Let the transaction be replaced by one paying a higher fee, see bumpfee")
+	bumpFeeID := bumpFeeCmd.String("txid", "", "The ID of the sent transaction")
+	bumpFeeFee := bumpFeeCmd.Int("fee", 0, "The fee to add, taken on the change")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode an send reward to the node")
+	startNodeWorkers := startNodeCmd.Int("workers", 0, "The number of mining goroutines, 0 uses every CPU")
+	getTransactionID := getTransactionCmd.String("txid", "", "The ID of the transaction")
+	getTxProofID := getTxProofCmd.String("txid", "", "The ID of the transaction")
+	verifyTxProofData := verifyTxProofCmd.String("proof", "", "The proof printed by gettxproof")
+	getSupplyHeight := getSupplyCmd.Int("height", -1, "The height of the supply, the tip by default")
+	getHistoryAddress := getHistoryCmd.String("address", "", "The address of the wallet")
+	getHistorySkip := getHistoryCmd.Int("skip", 0, "The number of transactions to skip from the oldest one")
+	getHistoryCount := getHistoryCmd.Int("count", 20, "The number of transactions to print")
 
 	// get the arguments throw the command
-	switch os.Args[1] {
+	switch args[0] {
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := printChainCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "startnode":
-		err := startNodeCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := startNodeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := getBalanceCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "createblockchain":
-		err := createBlockChainCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := createBlockChainCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := sendCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "bumpfee":
+		if err := bumpFeeCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "listaddresses":
-		err := listaddressesCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := listaddressesCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "createwallet":
-		err := createwalletCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := createwalletCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	case "reindexutxo":
-		err := reindexutxoCmd.Parse(os.Args[2:])
-		blockchain.ErrorHandler(err)
+		if err := reindexutxoCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "indextx":
+		if err := indextxCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "gettransaction":
+		if err := getTransactionCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "gettxproof":
+		if err := getTxProofCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "verifytxproof":
+		if err := verifyTxProofCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "getsupply":
+		if err := getSupplyCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "indexaddr":
+		if err := indexaddrCmd.Parse(args[1:]); err != nil {
+			return err
+		}
+	case "gethistory":
+		if err := getHistoryCmd.Parse(args[1:]); err != nil {
+			return err
+		}
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return errUsage
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain(nodeID)
+		return cli.printChain(nodeID)
 	}
 
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		return cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
 	if createBlockChainCmd.Parsed() {
 		if *createBlockChainAddress == "" {
 			createBlockChainCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
-		cli.createBlockChain(*createBlockChainAddress, nodeID)
+		return cli.createBlockChain(*createBlockChainAddress, nodeID)
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return errUsage
+		}
+		return cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, nodeID, *sendMine, *sendRBF)
+	}
+
+	if bumpFeeCmd.Parsed() {
+		if *bumpFeeID == "" || *bumpFeeFee <= 0 {
+			bumpFeeCmd.Usage()
+			return errUsage
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		return cli.bumpFee(*bumpFeeID, *bumpFeeFee, nodeID)
 	}
 
 	if createwalletCmd.Parsed() {
-		cli.createWallet(nodeID)
+		return cli.createWallet(nodeID)
 	}
 
 	if listaddressesCmd.Parsed() {
-		cli.listAddresses(nodeID)
+		return cli.listAddresses(nodeID)
 	}
 
 	if reindexutxoCmd.Parsed() {
-		cli.reindexUTXO(nodeID)
+		return cli.reindexUTXO(nodeID)
+	}
+
+	if indextxCmd.Parsed() {
+		return cli.indexTransactions(nodeID)
+	}
+
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			return errUsage
+		}
+		return cli.getTransaction(*getTransactionID, nodeID)
+	}
+
+	if getTxProofCmd.Parsed() {
+		if *getTxProofID == "" {
+			getTxProofCmd.Usage()
+			return errUsage
+		}
+		return cli.getTxProof(*getTxProofID, nodeID)
+	}
+
+	if verifyTxProofCmd.Parsed() {
+		if *verifyTxProofData == "" {
+			verifyTxProofCmd.Usage()
+			return errUsage
+		}
+		return cli.verifyTxProof(*verifyTxProofData)
+	}
+
+	if getSupplyCmd.Parsed() {
+		return cli.getSupply(*getSupplyHeight, nodeID)
+	}
+
+	if indexaddrCmd.Parsed() {
+		return cli.indexAddresses(nodeID)
+	}
+
+	if getHistoryCmd.Parsed() {
+		if *getHistoryAddress == "" || *getHistorySkip < 0 || *getHistoryCount <= 0 {
+			getHistoryCmd.Usage()
+			return errUsage
+		}
+		return cli.getHistory(*getHistoryAddress, *getHistorySkip, *getHistoryCount, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
-			runtime.Goexit()
+			return errUsage
 		}
 
-		cli.StartNode(nodeID, *startNodeMiner)
+		network.MinerWorkers = *startNodeWorkers
+		return cli.StartNode(nodeID, *startNodeMiner)
 	}
+
+	return nil
 }
@@ -0,0 +1,297 @@
+// Package codec implements the canonical binary encoding of the chain data,
+// the one used to hash it, to store it and to send it between the nodes. A
+// value has a single encoding, so it can be hashed, and the format doesn't
+// depend on Go, so other tools can parse the chain:
+//
+//	record  = version value      the version is one byte, currently 1
+//	bool    = 1 byte, 0 or 1
+//	int     = 8 bytes, big endian two's complement (int and int64)
+//	uint32  = 4 bytes, big endian
+//	uint64  = 8 bytes, big endian
+//	bytes   = length data        []byte and string, the length is an uint32
+//	slice   = count element*     the count is an uint32
+//	pointer = 0 when nil, else 1 then the value
+//	struct  = its exported fields in the order of their declaration, an
+//	          embedded struct is encoded as a field
+//
+// The field order of an encoded type is the order of its declaration, a field
+// can't be moved without a new version.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Version of the format written by Marshal
+const Version = 1
+
+var (
+	ErrUnsupported = errors.New("Type has no canonical encoding")
+	ErrMalformed   = errors.New("Data is not a canonical encoding")
+)
+
+// Encode the value into a record, a pointer is encoded as the value it points
+// to like Unmarshal decodes it
+func Marshal(value interface{}) ([]byte, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, fmt.Errorf("%w: nil %T", ErrUnsupported, value)
+		}
+		v = v.Elem()
+	}
+
+	e := encoder{[]byte{Version}}
+	if err := e.encode(v); err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+// Decode a record into the value pointed to, the record must hold nothing
+// else than the value
+func Unmarshal(data []byte, value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return fmt.Errorf("%w: decoding into %T", ErrUnsupported, value)
+	}
+
+	if len(data) == 0 {
+		return fmt.Errorf("%w: empty record", ErrMalformed)
+	}
+	if data[0] != Version {
+		return fmt.Errorf("%w: unknown version %d", ErrMalformed, data[0])
+	}
+
+	d := decoder{data[1:]}
+	if err := d.decode(v.Elem()); err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%w: %d bytes after the value", ErrMalformed, len(d.data))
+	}
+
+	return nil
+}
+
+type encoder struct {
+	data []byte
+}
+
+func (e *encoder) uint32(n uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	e.data = append(e.data, b[:]...)
+}
+
+func (e *encoder) uint64(n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	e.data = append(e.data, b[:]...)
+}
+
+func (e *encoder) length(n int) error {
+	if uint64(n) > math.MaxUint32 {
+		return fmt.Errorf("%w: length %d", ErrUnsupported, n)
+	}
+	e.uint32(uint32(n))
+	return nil
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.data = append(e.data, 1)
+		} else {
+			e.data = append(e.data, 0)
+		}
+	case reflect.Int, reflect.Int64:
+		e.uint64(uint64(v.Int()))
+	case reflect.Uint32:
+		e.uint32(uint32(v.Uint()))
+	case reflect.Uint64:
+		e.uint64(v.Uint())
+	case reflect.String:
+		if err := e.length(v.Len()); err != nil {
+			return err
+		}
+		e.data = append(e.data, v.String()...)
+	case reflect.Slice:
+		if err := e.length(v.Len()); err != nil {
+			return err
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.data = append(e.data, v.Bytes()...)
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			e.data = append(e.data, 0)
+			return nil
+		}
+		e.data = append(e.data, 1)
+		return e.encode(v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			// the unexported fields have a package path
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			if err := e.encode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+
+	return nil
+}
+
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data) {
+		return nil, fmt.Errorf("%w: %d bytes missing", ErrMalformed, n-len(d.data))
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	b, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Read a length, every element takes at least one byte so a length above
+// the data left can't be valid and nothing is allocated for it
+func (d *decoder) length() (int, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return 0, err
+	}
+	if uint64(n) > uint64(len(d.data)) {
+		return 0, fmt.Errorf("%w: length %d with %d bytes left", ErrMalformed, n, len(d.data))
+	}
+	return int(n), nil
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		if b[0] > 1 {
+			return fmt.Errorf("%w: bool %d", ErrMalformed, b[0])
+		}
+		v.SetBool(b[0] == 1)
+	case reflect.Int, reflect.Int64:
+		n, err := d.uint64()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(int64(n)) {
+			return fmt.Errorf("%w: %d overflows %s", ErrMalformed, int64(n), v.Type())
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint32:
+		n, err := d.uint32()
+		if err != nil {
+			return err
+		}
+		v.SetUint(uint64(n))
+	case reflect.Uint64:
+		n, err := d.uint64()
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.String:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		b, _ := d.next(n)
+		v.SetString(string(b))
+	case reflect.Slice:
+		n, err := d.length()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, _ := d.next(n)
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		s := reflect.MakeSlice(v.Type(), n, n)
+		for i := 0; i < n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Ptr:
+		b, err := d.next(1)
+		if err != nil {
+			return err
+		}
+		switch b[0] {
+		case 0:
+			v.Set(reflect.Zero(v.Type()))
+		case 1:
+			elem := reflect.New(v.Type().Elem())
+			if err := d.decode(elem.Elem()); err != nil {
+				return err
+			}
+			v.Set(elem)
+		default:
+			return fmt.Errorf("%w: pointer flag %d", ErrMalformed, b[0])
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			// the unexported fields have a package path
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			if err := d.decode(v.Field(i)); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupported, v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package codec_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+	"github.com/savecomdev/blockchain-pow-go/codec"
+)
+
+// Join the hex of the fields of a vector, the spaces are only for reading
+func unhex(t *testing.T, fields ...string) []byte {
+	t.Helper()
+
+	data, err := hex.DecodeString(strings.ReplaceAll(strings.Join(fields, ""), " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testTransaction() *blockchain.Transaction {
+	return &blockchain.Transaction{
+		ID: []byte{0xaa},
+		Inputs: []blockchain.TxInput{
+			{ID: []byte{0x01, 0x02}, Out: 1, Signature: []byte{0x03}, PubKey: []byte{0x04}},
+			// the sequence sits above the index of the output
+			{ID: []byte{0x05}, Out: blockchain.OutPoint(2, blockchain.SequenceReplaceable), Signature: []byte{0x06}, PubKey: []byte{0x07}},
+		},
+		Outputs: []blockchain.TxOutput{
+			{Value: 5, PubKeyHash: []byte{0x08, 0x09}},
+		},
+	}
+}
+
+// Fields of the transaction of testTransaction, without the version
+var testTransactionFields = []string{
+	"00000001 aa",
+	"00000002",
+	"00000002 0102", "0000000000000001", "00000001 03", "00000001 04",
+	"00000001 05", "0000000100000002", "00000001 06", "00000001 07",
+	"00000001",
+	"0000000000000005", "00000002 0809",
+}
+
+func testHeader() blockchain.BlockHeader {
+	return blockchain.BlockHeader{
+		Version:    1,
+		PrevHash:   []byte{0x11},
+		MerkleRoot: []byte{0x22},
+		Timestamp:  0x5f5e1000,
+		Bits:       12,
+		Nonce:      -2,
+		Height:     3,
+	}
+}
+
+var testHeaderFields = []string{
+	"0000000000000001",
+	"00000001 11",
+	"00000001 22",
+	"000000005f5e1000",
+	"000000000000000c",
+	"fffffffffffffffe",
+	"0000000000000003",
+}
+
+func TestTransactionVector(t *testing.T) {
+	expected := unhex(t, append([]string{"01"}, testTransactionFields...)...)
+
+	data, err := codec.Marshal(testTransaction())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Fatalf("encoding %x, expected %x", data, expected)
+	}
+	if serialized := testTransaction().Serialize(); !reflect.DeepEqual(serialized, expected) {
+		t.Fatalf("serialized %x, expected %x", serialized, expected)
+	}
+
+	tx, err := blockchain.DeserializeTransaction(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&tx, testTransaction()) {
+		t.Fatalf("decoded %+v, expected %+v", tx, testTransaction())
+	}
+}
+
+func TestHeaderVector(t *testing.T) {
+	header := testHeader()
+	expected := unhex(t, append([]string{"01"}, testHeaderFields...)...)
+
+	if data := header.Serialize(); !reflect.DeepEqual(data, expected) {
+		t.Fatalf("encoding %x, expected %x", data, expected)
+	}
+
+	decoded, err := blockchain.DeserializeHeader(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*decoded, header) {
+		t.Fatalf("decoded %+v, expected %+v", *decoded, header)
+	}
+}
+
+func TestBlockVector(t *testing.T) {
+	block := &blockchain.Block{
+		BlockHeader:  testHeader(),
+		Hash:         []byte{0x33},
+		Transactions: []*blockchain.Transaction{testTransaction()},
+	}
+
+	// the embedded header is encoded as a field, each transaction is a
+	// pointer
+	fields := []string{"01"}
+	fields = append(fields, testHeaderFields...)
+	fields = append(fields, "00000001 33", "00000001", "01")
+	fields = append(fields, testTransactionFields...)
+	expected := unhex(t, fields...)
+
+	if data := block.Serialize(); !reflect.DeepEqual(data, expected) {
+		t.Fatalf("encoding %x, expected %x", data, expected)
+	}
+
+	decoded, err := blockchain.Deserialize(expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, block) {
+		t.Fatalf("decoded %+v, expected %+v", decoded, block)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	type inner struct {
+		Flag bool
+	}
+	type value struct {
+		Int     int
+		Int64   int64
+		Uint32  uint32
+		Uint64  uint64
+		Text    string
+		Data    []byte
+		Values  []int
+		Pointer *inner
+		Nil     *inner
+		Inner   inner
+		skipped int
+	}
+
+	original := value{
+		Int:     -1,
+		Int64:   1 << 40,
+		Uint32:  7,
+		Uint64:  1 << 63,
+		Text:    "text",
+		Data:    []byte{1, 2, 3},
+		Values:  []int{4, 5},
+		Pointer: &inner{true},
+		Inner:   inner{true},
+	}
+
+	data, err := codec.Marshal(&original)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded value
+	if err := codec.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, original) {
+		t.Fatalf("decoded %+v, expected %+v", decoded, original)
+	}
+
+	// the unexported fields aren't encoded
+	original.skipped = 1
+	if other, _ := codec.Marshal(&original); !reflect.DeepEqual(other, data) {
+		t.Fatal("an unexported field changed the encoding")
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	valid := testTransaction().Serialize()
+
+	wrongVersion := append([]byte{codec.Version + 1}, valid[1:]...)
+	trailing := append(append([]byte{}, valid...), 0)
+	truncated := valid[:len(valid)-1]
+	// the length of the ID is past the end of the data
+	longLength := append([]byte{codec.Version}, unhex(t, "ffffffff")...)
+
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong version", wrongVersion},
+		{"trailing byte", trailing},
+		{"truncated", truncated},
+		{"long length", longLength},
+	}
+
+	for _, c := range cases {
+		var tx blockchain.Transaction
+		if err := codec.Unmarshal(c.data, &tx); !errors.Is(err, codec.ErrMalformed) {
+			t.Errorf("%s: expected %s, got %v", c.name, codec.ErrMalformed, err)
+		}
+	}
+
+	var flag struct{ Flag bool }
+	if err := codec.Unmarshal([]byte{codec.Version, 2}, &flag); !errors.Is(err, codec.ErrMalformed) {
+		t.Errorf("bool 2: expected %s, got %v", codec.ErrMalformed, err)
+	}
+
+	var pointer struct{ Pointer *struct{ Flag bool } }
+	if err := codec.Unmarshal([]byte{codec.Version, 2}, &pointer); !errors.Is(err, codec.ErrMalformed) {
+		t.Errorf("pointer flag 2: expected %s, got %v", codec.ErrMalformed, err)
+	}
+}
@@ -1,15 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
 
 	"github.com/savecomdev/blockchain-pow-go/cli"
 )
 
 func main() {
-	defer os.Exit(0)
-
 	// create the command line struct
 	cmd := cli.CommandLine{}
-	cmd.Run()
+	if err := cmd.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,416 @@
+// Package mempool keeps the transactions waiting for a block. Every
+// transaction is checked against the UTXO set before it enters the pool, an
+// output can be spent by a single transaction of the pool, and the pool is
+// bounded: past its limits the lowest fee rates are evicted, and the
+// transactions which waited too long expire.
+package mempool
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+)
+
+// Reasons for a transaction to be refused by the pool, check them with
+// errors.Is. The consensus errors of the chain are returned as they are.
+var (
+	ErrAlreadyHave = errors.New("Transaction is already into the memory pool")
+	ErrConflict    = errors.New("Transaction spends an output already spent")
+	ErrPoolFull    = errors.New("Memory pool is full of transactions paying a higher fee rate")
+	ErrOrphan      = errors.New("Transaction spends outputs of unknown transactions")
+	ErrReplacement = errors.New("Transaction can't replace the ones it conflicts with")
+)
+
+// Limits of the pool
+type Policy struct {
+	// total size in bytes of the transactions
+	MaxSize int
+	// number of transactions
+	MaxCount int
+	// time a transaction can wait into the pool, 0 keeps them until a block
+	// holds them
+	Expiry time.Duration
+
+	// number of orphans kept waiting for their parents, and for how long
+	MaxOrphans   int
+	OrphanExpiry time.Duration
+}
+
+var DefaultPolicy = Policy{
+	MaxSize:      1 << 20,
+	MaxCount:     5000,
+	Expiry:       72 * time.Hour,
+	MaxOrphans:   100,
+	OrphanExpiry: 20 * time.Minute,
+}
+
+// Transaction of the pool with what it takes to pick it into a block
+type TxDesc struct {
+	Tx    *blockchain.Transaction
+	Fee   int
+	Size  int
+	Added time.Time
+}
+
+// Compare the fee rates without dividing, the ID breaks the ties so the order
+// is the same on every node
+func (desc *TxDesc) higherFeeRate(other *TxDesc) bool {
+	a, b := desc.Fee*other.Size, other.Fee*desc.Size
+	if a != b {
+		return a > b
+	}
+	return bytes.Compare(desc.Tx.ID, other.Tx.ID) < 0
+}
+
+// Pool of transactions, safe for concurrent use
+type Pool struct {
+	chain  *blockchain.BlockChain
+	policy Policy
+
+	lock sync.RWMutex
+	txs  map[string]*TxDesc
+	// transaction of the pool spending each outpoint
+	spent map[string]*TxDesc
+	size  int
+
+	orphans *orphanPool
+}
+
+func New(chain *blockchain.BlockChain, policy Policy) *Pool {
+	return &Pool{
+		chain:  chain,
+		policy: policy,
+		txs:    make(map[string]*TxDesc),
+		spent:  make(map[string]*TxDesc),
+
+		orphans: newOrphanPool(),
+	}
+}
+
+func outpoint(txID []byte, out int) string {
+	return fmt.Sprintf("%x:%d", txID, out)
+}
+
+// Add the transaction once it is valid into the next block and doesn't spend
+// an output spent by another transaction of the pool or by the chain. A
+// transaction spending transactions the chain and the pool don't know is kept
+// as an orphan, the error is ErrOrphan, and it is added once its parents are.
+func (p *Pool) Accept(tx *blockchain.Transaction) (*TxDesc, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.accept(tx)
+}
+
+func (p *Pool) accept(tx *blockchain.Transaction) (*TxDesc, error) {
+	p.expire()
+	p.expireOrphans()
+
+	desc, err := p.acceptTx(tx)
+	if errors.Is(err, blockchain.ErrMissingInput) {
+		orphan, findErr := p.missingParent(tx)
+		if findErr != nil {
+			return nil, findErr
+		}
+		if !orphan {
+			return nil, fmt.Errorf("%w: %s", ErrConflict, err)
+		}
+		p.addOrphan(tx)
+		return nil, fmt.Errorf("%w: %x", ErrOrphan, tx.ID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	p.processOrphans(tx)
+
+	return desc, nil
+}
+
+// Add the transaction to the pool when it is valid
+func (p *Pool) acceptTx(tx *blockchain.Transaction) (*TxDesc, error) {
+	ID := hex.EncodeToString(tx.ID)
+	if _, ok := p.txs[ID]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrAlreadyHave, ID)
+	}
+
+	var conflicts []*TxDesc
+	for _, in := range tx.Inputs {
+		other, ok := p.spent[outpoint(in.ID, in.Index())]
+		if !ok {
+			continue
+		}
+		// only the transactions which signal it can be replaced, see replace
+		if !other.Tx.Replaceable() {
+			return nil, fmt.Errorf("%w: %s spends %x:%d like %x", ErrConflict, ID, in.ID, in.Index(), other.Tx.ID)
+		}
+		conflicts = append(conflicts, other)
+	}
+
+	if len(conflicts) > 0 {
+		return p.replace(tx, conflicts)
+	}
+
+	desc, err := p.validate(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.insert(desc); err != nil {
+		return nil, err
+	}
+
+	return desc, nil
+}
+
+// Check the transaction on the UTXO set seen through the pool, so it can
+// spend the outputs of the pool
+func (p *Pool) validate(tx *blockchain.Transaction) (*TxDesc, error) {
+	view := blockchain.NewUTXOView(p.overlay())
+	fee, err := p.chain.CheckMempoolTransactionView(tx, view)
+	if err != nil {
+		return nil, err
+	}
+	return &TxDesc{tx, fee, tx.Size(), time.Now()}, nil
+}
+
+// Add a valid transaction and bring the pool back within its limits. When
+// the transaction is evicted itself the ones evicted before it are added
+// back, the pool is left as it was.
+func (p *Pool) insert(desc *TxDesc) error {
+	p.add(desc)
+	evicted := p.trim()
+
+	if _, ok := p.txs[hex.EncodeToString(desc.Tx.ID)]; !ok {
+		for _, other := range evicted {
+			if other != desc {
+				p.add(other)
+			}
+		}
+		return fmt.Errorf("%w: %x pays %d for %d bytes", ErrPoolFull, desc.Tx.ID, desc.Fee, desc.Size)
+	}
+	return nil
+}
+
+// Replace the transactions conflicting with the transaction, which all signal
+// they are replaceable, and their descendants. The transaction must pay a
+// higher fee rate than each of the conflicting ones and a higher fee than all
+// the replaced ones together, and it can't spend what it replaces. The pool
+// is left as it was on an error.
+func (p *Pool) replace(tx *blockchain.Transaction, conflicts []*TxDesc) (*TxDesc, error) {
+	replaced := p.descendants(conflicts)
+
+	replacedFees := 0
+	for _, desc := range replaced {
+		for _, in := range tx.Inputs {
+			if bytes.Equal(in.ID, desc.Tx.ID) {
+				return nil, fmt.Errorf("%w: %x spends %x which it replaces", ErrReplacement, tx.ID, desc.Tx.ID)
+			}
+		}
+		replacedFees += desc.Fee
+	}
+
+	for _, desc := range replaced {
+		p.remove(desc)
+	}
+	restore := func() {
+		for _, desc := range replaced {
+			p.add(desc)
+		}
+	}
+
+	desc, err := p.validate(tx)
+	if err != nil {
+		restore()
+		return nil, err
+	}
+
+	if desc.Fee <= replacedFees {
+		restore()
+		return nil, fmt.Errorf("%w: %x pays %d, the replaced transactions %d", ErrReplacement, tx.ID, desc.Fee, replacedFees)
+	}
+	for _, conflict := range conflicts {
+		if !(desc.Fee*conflict.Size > conflict.Fee*desc.Size) {
+			restore()
+			return nil, fmt.Errorf("%w: %x pays a fee rate lower than %x", ErrReplacement, tx.ID, conflict.Tx.ID)
+		}
+	}
+
+	if err := p.insert(desc); err != nil {
+		restore()
+		return nil, err
+	}
+
+	return desc, nil
+}
+
+func (p *Pool) add(desc *TxDesc) {
+	p.txs[hex.EncodeToString(desc.Tx.ID)] = desc
+	for _, in := range desc.Tx.Inputs {
+		p.spent[outpoint(in.ID, in.Index())] = desc
+	}
+	p.size += desc.Size
+}
+
+func (p *Pool) remove(desc *TxDesc) {
+	delete(p.txs, hex.EncodeToString(desc.Tx.ID))
+	for _, in := range desc.Tx.Inputs {
+		delete(p.spent, outpoint(in.ID, in.Index()))
+	}
+	p.size -= desc.Size
+}
+
+// Evict the lowest fee rates until the pool is within its limits, only the
+// transactions without children into the pool are evicted so no transaction
+// loses its parent. Returns the evicted transactions.
+func (p *Pool) trim() []*TxDesc {
+	var evicted []*TxDesc
+	for len(p.txs) > p.policy.MaxCount || p.size > p.policy.MaxSize {
+		var lowest *TxDesc
+		for _, desc := range p.txs {
+			if len(p.children(desc)) > 0 {
+				continue
+			}
+			if lowest == nil || lowest.higherFeeRate(desc) {
+				lowest = desc
+			}
+		}
+		p.remove(lowest)
+		evicted = append(evicted, lowest)
+	}
+	return evicted
+}
+
+// Remove the transactions which waited past the expiry, returns their number
+func (p *Pool) Expire() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.expire()
+}
+
+func (p *Pool) expire() int {
+	if p.policy.Expiry == 0 {
+		return 0
+	}
+
+	count := len(p.txs)
+	limit := time.Now().Add(-p.policy.Expiry)
+	for _, desc := range p.txs {
+		// the children of an expired transaction go with it
+		if desc.Added.Before(limit) {
+			p.removeWithDescendants(desc)
+		}
+	}
+	return count - len(p.txs)
+}
+
+// Remove the transactions of a block joining the main chain, and the ones
+// spending the same outputs as its transactions with their descendants. The
+// children of a transaction of the block now spend the UTXO set.
+func (p *Pool) BlockConnected(block *blockchain.Block) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		if desc, ok := p.txs[hex.EncodeToString(tx.ID)]; ok {
+			p.remove(desc)
+		}
+
+		for _, in := range tx.Inputs {
+			if desc, ok := p.spent[outpoint(in.ID, in.Index())]; ok {
+				p.removeWithDescendants(desc)
+			}
+		}
+	}
+
+	// the outputs of the block are the parents of some orphans
+	for _, tx := range block.Transactions {
+		p.processOrphans(tx)
+	}
+}
+
+// Add back the transactions of a block leaving the main chain, the ones
+// which aren't valid on the new tip are dropped
+func (p *Pool) BlockDisconnected(block *blockchain.Block) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		p.accept(tx)
+	}
+}
+
+// Keep the pool in line with the main chain, to subscribe to the chain
+func (p *Pool) HandleNotification(n *blockchain.Notification) {
+	switch n.Type {
+	case blockchain.BlockConnected:
+		p.BlockConnected(n.Block)
+	case blockchain.BlockDisconnected:
+		p.BlockDisconnected(n.Block)
+	}
+}
+
+// Check if the transaction is into the pool
+func (p *Pool) Has(ID []byte) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.txs[hex.EncodeToString(ID)]
+	return ok
+}
+
+// Get a transaction of the pool
+func (p *Pool) Get(ID []byte) (*blockchain.Transaction, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	desc, ok := p.txs[hex.EncodeToString(ID)]
+	if !ok {
+		return nil, false
+	}
+	return desc.Tx, true
+}
+
+// Get the number of transactions of the pool
+func (p *Pool) Count() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.txs)
+}
+
+// Get the total size in bytes of the transactions of the pool
+func (p *Pool) Size() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.size
+}
+
+// Get the transactions of the pool from the highest fee rate
+func (p *Pool) TxDescs() []*TxDesc {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	descs := make([]*TxDesc, 0, len(p.txs))
+	for _, desc := range p.txs {
+		descs = append(descs, desc)
+	}
+
+	sort.Slice(descs, func(i, j int) bool { return descs[i].higherFeeRate(descs[j]) })
+
+	return descs
+}
@@ -0,0 +1,304 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+	"github.com/savecomdev/blockchain-pow-go/wallet"
+)
+
+// Chain in memory whose blocks after the genesis hold a coinbase paying the
+// wallet, the coinbases can be spent at once
+func newTestChain(t *testing.T, blocks int) (*blockchain.BlockChain, *wallet.Wallet, []*blockchain.Transaction) {
+	t.Helper()
+
+	params, err := blockchain.NetworkParams("regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params.CoinbaseMaturity = 0
+
+	w, err := wallet.MakeWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address())
+
+	chain, err := blockchain.NewBlockChain(blockchain.NewMemoryStore(), params, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var coinbases []*blockchain.Transaction
+	for height := 1; height <= blocks; height++ {
+		coinbase, err := blockchain.CoinBaseTx(address, "", height, params.Subsidy(height))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase}); err != nil {
+			t.Fatal(err)
+		}
+		coinbases = append(coinbases, coinbase)
+	}
+
+	return chain, w, coinbases
+}
+
+// Spend the output of the previous transaction into outputs of the wallet,
+// the fee is left out of the first one
+func spend(t *testing.T, w *wallet.Wallet, prev *blockchain.Transaction, out, sequence, fee, outputs int) *blockchain.Transaction {
+	t.Helper()
+
+	value := prev.Outputs[out].Value - fee
+	tx := &blockchain.Transaction{
+		Inputs: []blockchain.TxInput{{ID: prev.ID, Out: blockchain.OutPoint(out, sequence), PubKey: w.PublicKey}},
+	}
+	for i := 0; i < outputs; i++ {
+		outValue := value / outputs
+		if i == 0 {
+			outValue += value % outputs
+		}
+		output, err := blockchain.NewTXOutput(outValue, string(w.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Outputs = append(tx.Outputs, *output)
+	}
+
+	if err := tx.SignOutputs(w.PrivateKey, []blockchain.TxOutput{prev.Outputs[out]}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func accept(t *testing.T, pool *Pool, tx *blockchain.Transaction) {
+	t.Helper()
+
+	if _, err := pool.Accept(tx); err != nil {
+		t.Fatalf("accepting %x: %s", tx.ID, err)
+	}
+}
+
+func TestAcceptConflict(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 1)
+	pool := New(chain, DefaultPolicy)
+
+	tx := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	accept(t, pool, tx)
+
+	if _, err := pool.Accept(tx); !errors.Is(err, ErrAlreadyHave) {
+		t.Fatalf("expected %s, got %v", ErrAlreadyHave, err)
+	}
+
+	double := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 5, 1)
+	if _, err := pool.Accept(double); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected %s, got %v", ErrConflict, err)
+	}
+	if pool.Count() != 1 || !pool.Has(tx.ID) {
+		t.Fatal("the conflict changed the pool")
+	}
+
+	// the child spends the output of the pool
+	child := spend(t, w, tx, 0, blockchain.SequenceFinal, 1, 1)
+	accept(t, pool, child)
+}
+
+func TestAcceptSpentByChain(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 1)
+	pool := New(chain, DefaultPolicy)
+
+	tx := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	coinbase, err := blockchain.CoinBaseTx(string(w.Address()), "", 2, chain.Params.Subsidy(2)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.MineBlock([]*blockchain.Transaction{coinbase, tx}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is spent into the tip, the transaction isn't an orphan
+	double := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 2, 1)
+	if _, err := pool.Accept(double); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected %s, got %v", ErrConflict, err)
+	}
+	if pool.OrphanCount() != 0 {
+		t.Fatal("the double spend waits as an orphan")
+	}
+}
+
+func TestTrimEvictsLowestFeeRate(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 4)
+
+	policy := DefaultPolicy
+	policy.MaxCount = 2
+	pool := New(chain, policy)
+
+	low := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	mid := spend(t, w, coinbases[1], 0, blockchain.SequenceFinal, 2, 1)
+	high := spend(t, w, coinbases[2], 0, blockchain.SequenceFinal, 3, 1)
+	accept(t, pool, low)
+	accept(t, pool, mid)
+	accept(t, pool, high)
+
+	if pool.Count() != 2 || pool.Has(low.ID) {
+		t.Fatal("the lowest fee rate wasn't evicted")
+	}
+
+	lower := spend(t, w, coinbases[3], 0, blockchain.SequenceFinal, 1, 1)
+	if _, err := pool.Accept(lower); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("expected %s, got %v", ErrPoolFull, err)
+	}
+	if pool.Count() != 2 || !pool.Has(mid.ID) || !pool.Has(high.ID) {
+		t.Fatal("a refused transaction changed the pool")
+	}
+}
+
+func TestRefusedTransactionKeepsTheEvicted(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 3)
+
+	small := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	high := spend(t, w, coinbases[1], 0, blockchain.SequenceFinal, 10, 1)
+	// a large transaction paying a fee rate between the two small ones
+	large := spend(t, w, coinbases[2], 0, blockchain.SequenceFinal, 2, 5)
+	if !(large.Size() > small.Size() && 2*small.Size() > large.Size()) {
+		t.Fatalf("sizes %d and %d don't fit the test", small.Size(), large.Size())
+	}
+
+	policy := DefaultPolicy
+	policy.MaxSize = small.Size() + high.Size()
+	pool := New(chain, policy)
+	accept(t, pool, small)
+	accept(t, pool, high)
+
+	// evicting the small transaction isn't enough, the large one goes next
+	if _, err := pool.Accept(large); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("expected %s, got %v", ErrPoolFull, err)
+	}
+	if pool.Count() != 2 || !pool.Has(small.ID) || !pool.Has(high.ID) {
+		t.Fatal("the transactions evicted for the refused one are lost")
+	}
+	if pool.Size() != policy.MaxSize {
+		t.Fatalf("size %d, expected %d", pool.Size(), policy.MaxSize)
+	}
+}
+
+func TestTrimKeepsParents(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 2)
+
+	policy := DefaultPolicy
+	policy.MaxCount = 2
+	pool := New(chain, policy)
+
+	parent := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	child := spend(t, w, parent, 0, blockchain.SequenceFinal, 2, 1)
+	accept(t, pool, parent)
+	accept(t, pool, child)
+
+	// the parent pays the lowest fee rate but has a child
+	other := spend(t, w, coinbases[1], 0, blockchain.SequenceFinal, 3, 1)
+	accept(t, pool, other)
+
+	if !pool.Has(parent.ID) || pool.Has(child.ID) || !pool.Has(other.ID) {
+		t.Fatal("a parent was evicted before its child")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 2)
+
+	policy := DefaultPolicy
+	policy.Expiry = time.Hour
+	pool := New(chain, policy)
+
+	parent := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	child := spend(t, w, parent, 0, blockchain.SequenceFinal, 1, 1)
+	other := spend(t, w, coinbases[1], 0, blockchain.SequenceFinal, 1, 1)
+	accept(t, pool, parent)
+	accept(t, pool, child)
+	accept(t, pool, other)
+
+	pool.txs[hex.EncodeToString(parent.ID)].Added = time.Now().Add(-2 * time.Hour)
+
+	if expired := pool.Expire(); expired != 2 {
+		t.Fatalf("%d expired, expected the parent with its child", expired)
+	}
+	if pool.Count() != 1 || !pool.Has(other.ID) {
+		t.Fatal("the wrong transactions expired")
+	}
+}
+
+func TestReplaceByFee(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 2)
+	pool := New(chain, DefaultPolicy)
+
+	// a final transaction can't be replaced
+	final := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 1)
+	accept(t, pool, final)
+	if _, err := pool.Accept(spend(t, w, coinbases[0], 0, blockchain.SequenceReplaceable, 5, 1)); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected %s, got %v", ErrConflict, err)
+	}
+
+	replaceable := spend(t, w, coinbases[1], 0, blockchain.SequenceReplaceable, 1, 1)
+	child := spend(t, w, replaceable, 0, blockchain.SequenceFinal, 2, 1)
+	accept(t, pool, replaceable)
+	accept(t, pool, child)
+
+	// the replacement pays more than the transaction but not more than it
+	// with its child
+	cheap := spend(t, w, coinbases[1], 0, blockchain.SequenceReplaceable, 2, 1)
+	if _, err := pool.Accept(cheap); !errors.Is(err, ErrReplacement) {
+		t.Fatalf("expected %s, got %v", ErrReplacement, err)
+	}
+	if pool.Count() != 3 || !pool.Has(replaceable.ID) || !pool.Has(child.ID) {
+		t.Fatal("a refused replacement changed the pool")
+	}
+
+	replacement := spend(t, w, coinbases[1], 0, blockchain.SequenceReplaceable, 4, 1)
+	desc, err := pool.Accept(replacement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Fee != 4 {
+		t.Fatalf("fee %d, expected 4", desc.Fee)
+	}
+	if pool.Has(replaceable.ID) || pool.Has(child.ID) || !pool.Has(replacement.ID) {
+		t.Fatal("the replaced transactions are still into the pool")
+	}
+}
+
+func TestOrphans(t *testing.T) {
+	chain, w, coinbases := newTestChain(t, 1)
+
+	policy := DefaultPolicy
+	policy.MaxOrphans = 1
+	pool := New(chain, policy)
+
+	parent := spend(t, w, coinbases[0], 0, blockchain.SequenceFinal, 1, 2)
+	child := spend(t, w, parent, 0, blockchain.SequenceFinal, 1, 1)
+	other := spend(t, w, parent, 1, blockchain.SequenceFinal, 1, 1)
+
+	if _, err := pool.Accept(child); !errors.Is(err, ErrOrphan) {
+		t.Fatalf("expected %s, got %v", ErrOrphan, err)
+	}
+	if !pool.HasOrphan(child.ID) || pool.Count() != 0 {
+		t.Fatal("the orphan isn't waiting")
+	}
+
+	// the oldest orphan is dropped past the limit
+	time.Sleep(time.Millisecond)
+	if _, err := pool.Accept(other); !errors.Is(err, ErrOrphan) {
+		t.Fatalf("expected %s, got %v", ErrOrphan, err)
+	}
+	if pool.HasOrphan(child.ID) || !pool.HasOrphan(other.ID) {
+		t.Fatal("the oldest orphan wasn't dropped")
+	}
+
+	accept(t, pool, parent)
+	if !pool.Has(other.ID) || pool.OrphanCount() != 0 {
+		t.Fatal("the orphan wasn't added with its parent")
+	}
+}
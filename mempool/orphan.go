@@ -0,0 +1,162 @@
+package mempool
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+)
+
+// Transaction waiting for the transactions it spends
+type orphan struct {
+	tx    *blockchain.Transaction
+	added time.Time
+}
+
+// Orphans by ID and by the ID of the transactions they spend
+type orphanPool struct {
+	txs      map[string]*orphan
+	byParent map[string]map[string]*orphan
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		txs:      make(map[string]*orphan),
+		byParent: make(map[string]map[string]*orphan),
+	}
+}
+
+// Keep the transaction until its parents are known, the oldest orphan is
+// dropped when there are too many of them
+func (p *Pool) addOrphan(tx *blockchain.Transaction) {
+	ID := hex.EncodeToString(tx.ID)
+	if _, ok := p.orphans.txs[ID]; ok {
+		return
+	}
+	if p.policy.MaxOrphans <= 0 {
+		return
+	}
+
+	for len(p.orphans.txs) >= p.policy.MaxOrphans {
+		var oldest *orphan
+		for _, o := range p.orphans.txs {
+			if oldest == nil || o.added.Before(oldest.added) {
+				oldest = o
+			}
+		}
+		p.removeOrphan(oldest)
+	}
+
+	o := &orphan{tx, time.Now()}
+	p.orphans.txs[ID] = o
+
+	for _, in := range tx.Inputs {
+		parentID := hex.EncodeToString(in.ID)
+		if p.orphans.byParent[parentID] == nil {
+			p.orphans.byParent[parentID] = make(map[string]*orphan)
+		}
+		p.orphans.byParent[parentID][ID] = o
+	}
+}
+
+func (p *Pool) removeOrphan(o *orphan) {
+	ID := hex.EncodeToString(o.tx.ID)
+	delete(p.orphans.txs, ID)
+
+	for _, in := range o.tx.Inputs {
+		parentID := hex.EncodeToString(in.ID)
+		delete(p.orphans.byParent[parentID], ID)
+		if len(p.orphans.byParent[parentID]) == 0 {
+			delete(p.orphans.byParent, parentID)
+		}
+	}
+}
+
+// Check if a transaction spends a transaction unknown to the pool and to the
+// chain. An input missing from the UTXO set whose transaction is known
+// spends an output already spent, the transaction isn't an orphan. The chain
+// is searched through its transaction index when it keeps one.
+func (p *Pool) missingParent(tx *blockchain.Transaction) (bool, error) {
+	utxo := blockchain.UTXOSet{Blockchain: p.chain}
+
+	for _, in := range tx.Inputs {
+		if _, ok := p.txs[hex.EncodeToString(in.ID)]; ok {
+			continue
+		}
+
+		_, found, err := utxo.FindOutputs(in.ID)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			continue
+		}
+
+		_, err = p.chain.FindTransaction(in.ID)
+		if errors.Is(err, blockchain.ErrTxNotFound) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Try the orphans spending the transaction, and the orphans of the ones
+// accepted in turn. An orphan still missing a parent keeps waiting, one
+// refused for another reason is dropped.
+func (p *Pool) processOrphans(parent *blockchain.Transaction) {
+	queue := []*blockchain.Transaction{parent}
+
+	for len(queue) > 0 {
+		parentID := hex.EncodeToString(queue[0].ID)
+		queue = queue[1:]
+
+		for _, o := range p.orphans.byParent[parentID] {
+			desc, err := p.acceptTx(o.tx)
+			if errors.Is(err, blockchain.ErrMissingInput) {
+				if orphan, err := p.missingParent(o.tx); err != nil || orphan {
+					continue
+				}
+			}
+
+			p.removeOrphan(o)
+			if err == nil {
+				queue = append(queue, desc.Tx)
+			}
+		}
+	}
+}
+
+// Drop the orphans which waited past the expiry
+func (p *Pool) expireOrphans() {
+	if p.policy.OrphanExpiry == 0 {
+		return
+	}
+
+	limit := time.Now().Add(-p.policy.OrphanExpiry)
+	for _, o := range p.orphans.txs {
+		if o.added.Before(limit) {
+			p.removeOrphan(o)
+		}
+	}
+}
+
+// Check if the transaction waits for its parents
+func (p *Pool) HasOrphan(ID []byte) bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	_, ok := p.orphans.txs[hex.EncodeToString(ID)]
+	return ok
+}
+
+// Get the number of transactions waiting for their parents
+func (p *Pool) OrphanCount() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return len(p.orphans.txs)
+}
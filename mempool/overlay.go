@@ -0,0 +1,154 @@
+package mempool
+
+import (
+	"encoding/hex"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+)
+
+// UTXO set seen through the pool: the outputs of the transactions of the pool
+// can be spent, the ones the pool spends can't. The caller holds the lock.
+type overlay struct {
+	pool *Pool
+	utxo *blockchain.UTXOSet
+}
+
+func (p *Pool) overlay() overlay {
+	return overlay{p, &blockchain.UTXOSet{Blockchain: p.chain}}
+}
+
+// Remove from the outputs of the transaction the ones spent by the pool
+func (o overlay) unspent(txID []byte, outs blockchain.TxOutputs) blockchain.TxOutputs {
+	for _, outIdx := range outs.Indexes {
+		if _, ok := o.pool.spent[outpoint(txID, outIdx)]; ok {
+			outs = outs.Remove(outIdx)
+		}
+	}
+	return outs
+}
+
+// Get the outputs of a transaction of the pool, it isn't a coinbase so its
+// height doesn't matter
+func poolOutputs(tx *blockchain.Transaction) blockchain.TxOutputs {
+	outs := blockchain.TxOutputs{}
+	for outIdx, out := range tx.Outputs {
+		outs.Add(outIdx, out)
+	}
+	return outs
+}
+
+func (o overlay) FindOutputs(txID []byte) (blockchain.TxOutputs, bool, error) {
+	var outs blockchain.TxOutputs
+
+	if desc, ok := o.pool.txs[hex.EncodeToString(txID)]; ok {
+		outs = poolOutputs(desc.Tx)
+	} else {
+		var found bool
+		var err error
+		if outs, found, err = o.utxo.FindOutputs(txID); err != nil || !found {
+			return outs, found, err
+		}
+	}
+
+	outs = o.unspent(txID, outs)
+	return outs, len(outs.Outputs) > 0, nil
+}
+
+func (o overlay) ForEachOutputs(fn func(txID []byte, outs blockchain.TxOutputs) error) error {
+	err := o.utxo.ForEachOutputs(func(txID []byte, outs blockchain.TxOutputs) error {
+		if outs = o.unspent(txID, outs); len(outs.Outputs) == 0 {
+			return nil
+		}
+		return fn(txID, outs)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range o.pool.txs {
+		outs := o.unspent(desc.Tx.ID, poolOutputs(desc.Tx))
+		if len(outs.Outputs) == 0 {
+			continue
+		}
+		if err := fn(desc.Tx.ID, outs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Overlay which holds the read lock of the pool while it is read
+type lockedOverlay struct {
+	overlay
+}
+
+func (o lockedOverlay) FindOutputs(txID []byte) (blockchain.TxOutputs, bool, error) {
+	o.pool.lock.RLock()
+	defer o.pool.lock.RUnlock()
+
+	return o.overlay.FindOutputs(txID)
+}
+
+func (o lockedOverlay) ForEachOutputs(fn func(txID []byte, outs blockchain.TxOutputs) error) error {
+	o.pool.lock.RLock()
+	defer o.pool.lock.RUnlock()
+
+	return o.overlay.ForEachOutputs(fn)
+}
+
+// Get the UTXO set seen through the pool, a transaction built on it can spend
+// the outputs of the pool:
+//
+//	blockchain.NewTransactionFrom(w, to, amount, fee, true, chain, pool.Overlay())
+func (p *Pool) Overlay() blockchain.OutputSet {
+	return lockedOverlay{p.overlay()}
+}
+
+// Get the transactions of the pool spending the outputs of the transaction
+func (p *Pool) children(desc *TxDesc) []*TxDesc {
+	var children []*TxDesc
+	seen := make(map[*TxDesc]bool)
+
+	for outIdx := range desc.Tx.Outputs {
+		child, ok := p.spent[outpoint(desc.Tx.ID, outIdx)]
+		if ok && !seen[child] {
+			seen[child] = true
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// Get the transactions with every transaction of the pool which spends their
+// outputs, directly or not
+func (p *Pool) descendants(descs []*TxDesc) []*TxDesc {
+	var all []*TxDesc
+	seen := make(map[*TxDesc]bool)
+
+	for len(descs) > 0 {
+		desc := descs[0]
+		descs = descs[1:]
+
+		if seen[desc] {
+			continue
+		}
+		seen[desc] = true
+		all = append(all, desc)
+		descs = append(descs, p.children(desc)...)
+	}
+	return all
+}
+
+// Remove the transaction with every transaction of the pool which spends its
+// outputs, directly or not
+func (p *Pool) removeWithDescendants(desc *TxDesc) {
+	if _, ok := p.txs[hex.EncodeToString(desc.Tx.ID)]; !ok {
+		return
+	}
+
+	for _, child := range p.children(desc) {
+		p.removeWithDescendants(child)
+	}
+	p.remove(desc)
+}
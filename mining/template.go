@@ -0,0 +1,282 @@
+// Package mining builds the blocks of the node out of the memory pool. A
+// template holds the transactions picked for the next block, parents before
+// children, within the size and signature limits of the policy. A miner adds
+// the coinbase and searches the nonce, the template can be sent to an
+// external miner which does the same.
+package mining
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/savecomdev/blockchain-pow-go/blockchain"
+	"github.com/savecomdev/blockchain-pow-go/codec"
+	"github.com/savecomdev/blockchain-pow-go/mempool"
+)
+
+// Bytes left into the block for the header and the coinbase
+const coinbaseReserve = 1000
+
+var ErrBadTemplate = errors.New("Block template is malformed")
+
+// Limits of the blocks built by the node
+type Policy struct {
+	// size in bytes of the serialized block
+	MaxBlockSize int
+	// number of signatures checked by the transactions of the block
+	MaxSigOps int
+}
+
+var DefaultPolicy = Policy{
+	MaxBlockSize: 500000,
+	MaxSigOps:    4000,
+}
+
+// Next block on top of the tip, without its coinbase
+type BlockTemplate struct {
+	PrevHash []byte
+	Height   int
+	Bits     int
+
+	// transactions of the block after the coinbase, the parents before their
+	// children, and the fee of each one
+	Transactions []*blockchain.Transaction
+	Fees         []int
+
+	TotalFees int
+	Subsidy   int
+	// size in bytes and signatures checked of the transactions
+	Size   int
+	SigOps int
+}
+
+// Get the number of signatures checked by a transaction, one per input
+func SigOps(tx *blockchain.Transaction) int {
+	if tx.IsCoinbase() {
+		return 0
+	}
+	return len(tx.Inputs)
+}
+
+// Transaction of the pool valid into the next block, with its parents into
+// the pool
+type entry struct {
+	desc      *mempool.TxDesc
+	sigOps    int
+	ancestors map[*entry]bool
+}
+
+// Build the template of the next block out of the transactions of the pool.
+// The transaction whose package, itself with its ancestors left out of the
+// block, pays the highest fee rate is picked first, so a child paying for its
+// parents brings them into the block. A package over the limits is skipped.
+func NewBlockTemplate(chain *blockchain.BlockChain, pool *mempool.Pool, policy Policy) (*BlockTemplate, error) {
+	var tip *blockchain.Block
+	err := chain.Store.View(func(txn blockchain.StoreTxn) error {
+		hash, err := txn.GetTip()
+		if err != nil {
+			return err
+		}
+		tip, err = txn.GetBlock(hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bits, err := chain.NextDifficulty(&tip.BlockHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &BlockTemplate{
+		PrevHash: tip.Hash,
+		Height:   tip.Height + 1,
+		Bits:     bits,
+		Subsidy:  chain.Params.Subsidy(tip.Height + 1),
+	}
+
+	entries := validEntries(chain, pool, template.Height)
+
+	// the policy can't go past the consensus limit
+	maxSize := policy.MaxBlockSize
+	if maxSize > blockchain.MaxBlockSize {
+		maxSize = blockchain.MaxBlockSize
+	}
+	maxSize -= coinbaseReserve
+
+	included := make(map[*entry]bool)
+	skipped := make(map[*entry]bool)
+
+	for {
+		var best *entry
+		var bestPackage []*entry
+		bestFee, bestSize := 0, 0
+
+		for _, e := range entries {
+			if included[e] || skipped[e] {
+				continue
+			}
+
+			pkg := e.pending(included)
+			fee, size := 0, 0
+			for _, p := range pkg {
+				fee += p.desc.Fee
+				size += p.desc.Size
+			}
+
+			if best == nil || higherFeeRate(fee, size, e, bestFee, bestSize, best) {
+				best, bestPackage, bestFee, bestSize = e, pkg, fee, size
+			}
+		}
+
+		if best == nil {
+			break
+		}
+
+		sigOps := 0
+		for _, p := range bestPackage {
+			sigOps += p.sigOps
+		}
+		if template.Size+bestSize > maxSize || template.SigOps+sigOps > policy.MaxSigOps {
+			// the descendants of the transaction hold it into their package,
+			// they are skipped in turn
+			skipped[best] = true
+			continue
+		}
+
+		for _, p := range bestPackage {
+			included[p] = true
+			template.Transactions = append(template.Transactions, p.desc.Tx)
+			template.Fees = append(template.Fees, p.desc.Fee)
+		}
+		template.TotalFees += bestFee
+		template.Size += bestSize
+		template.SigOps += sigOps
+	}
+
+	return template, nil
+}
+
+// Check the transactions of the pool on a view of the next block, parents
+// first. The tip may have moved since a transaction was accepted, the ones
+// which aren't valid anymore are left out with their descendants.
+func validEntries(chain *blockchain.BlockChain, pool *mempool.Pool, height int) []*entry {
+	descs := pool.TxDescs()
+	byID := make(map[string]*mempool.TxDesc)
+	for _, desc := range descs {
+		byID[hex.EncodeToString(desc.Tx.ID)] = desc
+	}
+
+	view := blockchain.NewUTXOView(&blockchain.UTXOSet{Blockchain: chain})
+	entries := make(map[*mempool.TxDesc]*entry)
+	// the valid entries, nil for a refused transaction
+	var check func(desc *mempool.TxDesc) *entry
+	check = func(desc *mempool.TxDesc) *entry {
+		if e, done := entries[desc]; done {
+			return e
+		}
+		entries[desc] = nil
+
+		ancestors := make(map[*entry]bool)
+		for _, in := range desc.Tx.Inputs {
+			parentDesc, ok := byID[hex.EncodeToString(in.ID)]
+			if !ok {
+				continue
+			}
+			parent := check(parentDesc)
+			if parent == nil {
+				return nil
+			}
+			ancestors[parent] = true
+			for a := range parent.ancestors {
+				ancestors[a] = true
+			}
+		}
+
+		if _, err := blockchain.CheckTransactionInputs(desc.Tx, view, height, chain.Params.CoinbaseMaturity); err != nil {
+			return nil
+		}
+		if _, err := view.ConnectTransaction(desc.Tx, height); err != nil {
+			return nil
+		}
+
+		e := &entry{desc, SigOps(desc.Tx), ancestors}
+		entries[desc] = e
+		return e
+	}
+
+	var valid []*entry
+	for _, desc := range descs {
+		if e := check(desc); e != nil {
+			valid = append(valid, e)
+		}
+	}
+	return valid
+}
+
+// Get the transaction with its ancestors left out of the block, each one
+// after its ancestors
+func (e *entry) pending(included map[*entry]bool) []*entry {
+	pkg := []*entry{e}
+	for a := range e.ancestors {
+		if !included[a] {
+			pkg = append(pkg, a)
+		}
+	}
+
+	// an ancestor has fewer ancestors than its descendants
+	sort.Slice(pkg, func(i, j int) bool {
+		if len(pkg[i].ancestors) != len(pkg[j].ancestors) {
+			return len(pkg[i].ancestors) < len(pkg[j].ancestors)
+		}
+		return bytes.Compare(pkg[i].desc.Tx.ID, pkg[j].desc.Tx.ID) < 0
+	})
+	return pkg
+}
+
+// Compare the fee rates of two packages without dividing, the ID of the
+// transaction breaks the ties so the order is the same on every node
+func higherFeeRate(fee, size int, e *entry, otherFee, otherSize int, other *entry) bool {
+	a, b := fee*otherSize, otherFee*size
+	if a != b {
+		return a > b
+	}
+	return bytes.Compare(e.desc.Tx.ID, other.desc.Tx.ID) < 0
+}
+
+// Get the coinbase of the template paying the subsidy and the fees to the
+// address
+func (t *BlockTemplate) Coinbase(address string) (*blockchain.Transaction, error) {
+	return blockchain.CoinBaseTx(address, "", t.Height, t.Subsidy+t.TotalFees)
+}
+
+// Build the block of the template with the coinbase, the nonce is left to
+// the miner:
+//
+//	block := template.NewBlock(coinbase)
+//	pow, err := block.Mine(ctx, workers)
+func (t *BlockTemplate) NewBlock(coinbase *blockchain.Transaction) *blockchain.Block {
+	txs := append([]*blockchain.Transaction{coinbase}, t.Transactions...)
+	return blockchain.NewBlock(txs, t.PrevHash, t.Height, t.Bits)
+}
+
+func (t *BlockTemplate) Serialize() ([]byte, error) {
+	return codec.Marshal(t)
+}
+
+func DeserializeBlockTemplate(data []byte) (*BlockTemplate, error) {
+	var template BlockTemplate
+
+	if err := codec.Unmarshal(data, &template); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadTemplate, err)
+	}
+	if len(template.Fees) != len(template.Transactions) {
+		return nil, fmt.Errorf("%w: %d fees for %d transactions", ErrBadTemplate, len(template.Fees), len(template.Transactions))
+	}
+
+	return &template, nil
+}
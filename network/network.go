@@ -2,18 +2,23 @@ package network
 
 import (
 	"bytes"
-	"encoding/gob"
-	"encoding/hex"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
-	"runtime"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/savecomdev/blockchain-pow-go/blockchain"
+	"github.com/savecomdev/blockchain-pow-go/codec"
+	"github.com/savecomdev/blockchain-pow-go/mempool"
+	"github.com/savecomdev/blockchain-pow-go/mining"
 	"github.com/vrecan/death/v3"
 )
 
@@ -21,14 +26,41 @@ const (
 	protocol      = "tcp"
 	version       = 1
 	commandLength = 12
+	magicLength   = 4
+
+	// a block of the maximum size with its envelope
+	maxMessageSize = 2 * blockchain.MaxBlockSize
 )
 
 var (
 	nodeAddress     string
 	minerAddress    string
+	Params          = &blockchain.MainNetParams
 	KnownNodes      = []string{"localhost:3000"}
 	blocksInTransit = [][]byte{}
-	memoryPool      = make(map[string]blockchain.Transaction)
+	// last hash of a full batch of headers or inventory, the command claims
+	// the following ones once the blocks of the batch are downloaded
+	lastHash []byte
+	lastCmd  string
+
+	// the connections are handled on their own goroutine, nodesLock guards
+	// KnownNodes and syncLock the blocks being downloaded
+	nodesLock sync.Mutex
+	syncLock  sync.Mutex
+
+	// transactions waiting for a block, set when the server starts
+	memoryPool    *mempool.Pool
+	MempoolPolicy = mempool.DefaultPolicy
+
+	// limits of the blocks mined by the node and of the templates it serves
+	MiningPolicy = mining.DefaultPolicy
+
+	// number of mining goroutines, 0 means one per CPU
+	MinerWorkers int
+
+	// stops the block being mined when a new tip is connected
+	miningCancel context.CancelFunc
+	miningLock   sync.Mutex
 )
 
 type Addr struct {
@@ -40,8 +72,41 @@ type Block struct {
 	Block    []byte
 }
 
+// Asks the hashes of the main chain following the block From
 type GetBlocks struct {
 	AddrFrom string
+	From     []byte
+}
+
+// Asks the headers of the main chain following the block From
+type GetHeaders struct {
+	AddrFrom string
+	From     []byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
+// Asks the proof that a transaction sits into the main chain
+type GetProof struct {
+	AddrFrom string
+	TxID     []byte
+}
+
+type Proof struct {
+	AddrFrom string
+	Proof    []byte
+}
+
+type GetBlockTemplate struct {
+	AddrFrom string
+}
+
+type BlockTemplate struct {
+	AddrFrom string
+	Template []byte
 }
 
 type GetData struct {
@@ -67,12 +132,6 @@ type Version struct {
 	AddrFrom   string
 }
 
-func ErrorHandler(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
-}
-
 // Convert a command into slice of byte
 func CmdToBytes(cmd string) []byte {
 	var bytes [commandLength]byte
@@ -95,29 +154,74 @@ func BytesToCmd(bytes []byte) string {
 	return fmt.Sprintf("%s", cmd)
 }
 
-// Serialize the DB
-func GobEncode(data interface{}) []byte {
-	var buff bytes.Buffer
-	enc := gob.NewEncoder(&buff)
-	err := enc.Encode(data)
-	ErrorHandler(err)
-	return buff.Bytes()
+// Encode the payload of a request into its canonical form
+func Encode(data interface{}) ([]byte, error) {
+	return codec.Marshal(data)
+}
+
+// Decode the payload of a request following its command
+func Decode(request []byte, payload interface{}) error {
+	if err := codec.Unmarshal(request[commandLength:], payload); err != nil {
+		return fmt.Errorf("Invalid %s payload: %w", BytesToCmd(request[:commandLength]), err)
+	}
+	return nil
+}
+
+// Use the network of the params, the known nodes start with its peers
+func Setup(params *blockchain.ChainParams) {
+	Params = params
+
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+	KnownNodes = append([]string{}, params.DefaultPeers...)
 }
 
-// Close properly the DB
-func CloseDB(chain *blockchain.BlockChain) {
-	// open the DB
-	db := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+// Send a command with its payload to the address, the request starts with
+// the magic bytes of the network
+func sendCommand(address, cmd string, data interface{}) error {
+	payload, err := Encode(data)
+	if err != nil {
+		return err
+	}
 
-	db.WaitForDeathWithFunc(func() {
-		defer os.Exit(1)
-		defer runtime.Goexit()
-		chain.Database.Close()
+	request := make([]byte, magicLength, magicLength+commandLength+len(payload))
+	binary.BigEndian.PutUint32(request, Params.Magic)
+	request = append(request, CmdToBytes(cmd)...)
+	request = append(request, payload...)
+
+	return SendData(address, request)
+}
+
+// Stop the server on an interrupt, closing the listener makes StartServer
+// leave its loop and close the DB properly
+func CloseOnSignal(listener net.Listener) {
+	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+	d.WaitForDeathWithFunc(func() {
+		listener.Close()
 	})
 }
 
+// Keep the memory pool in line with the main chain, the transactions of a
+// connected block are removed and the ones of a disconnected block come back
+func HandleChainNotification(n *blockchain.Notification) {
+	// the block being mined doesn't extend the tip anymore
+	if n.Type == blockchain.BlockConnected {
+		stopMining()
+	}
+
+	memoryPool.HandleNotification(n)
+}
+
 // Check if the node address is into the current nodes list
 func NodeIsKnown(address string) bool {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	return nodeIsKnown(address)
+}
+
+func nodeIsKnown(address string) bool {
 	for _, node := range KnownNodes {
 		if node == address {
 			return true
@@ -126,11 +230,106 @@ func NodeIsKnown(address string) bool {
 	return false
 }
 
-// Loop to get the blocks from the peer into the pipe network
-func RequestBlocks() {
+// Copy of the known nodes, safe to range over while other connections
+// change them
+func knownNodes() []string {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	return append([]string{}, KnownNodes...)
+}
+
+// Add the addresses missing from the known nodes, returns their count
+func addNodes(addresses ...string) int {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	for _, address := range addresses {
+		if !nodeIsKnown(address) {
+			KnownNodes = append(KnownNodes, address)
+		}
+	}
+	return len(KnownNodes)
+}
+
+func removeNode(address string) {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	var updateNodes []string
 	for _, node := range KnownNodes {
-		SendGetBlock(node)
+		if node != address {
+			updateNodes = append(updateNodes, node)
+		}
 	}
+	KnownNodes = updateNodes
+}
+
+// Central node of the network, the first known one
+func centralNode() string {
+	nodesLock.Lock()
+	defer nodesLock.Unlock()
+
+	if len(KnownNodes) == 0 {
+		return ""
+	}
+	return KnownNodes[0]
+}
+
+// Start downloading the blocks, returns the first one to claim. Once the
+// blocks are downloaded the command claims the hashes following after, if any
+func startDownload(hashes [][]byte, cmd string, after []byte) []byte {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	blocksInTransit = hashes[1:]
+	lastHash = after
+	lastCmd = cmd
+	return hashes[0]
+}
+
+// Next block to claim, or once the blocks are downloaded the command claiming
+// the hashes following after. Both are nil when the download is over
+func nextDownload() (block []byte, cmd string, after []byte) {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	if len(blocksInTransit) > 0 {
+		block = blocksInTransit[0]
+		blocksInTransit = blocksInTransit[1:]
+		return block, "", nil
+	}
+
+	after, cmd = lastHash, lastCmd
+	lastHash, lastCmd = nil, ""
+	return nil, cmd, after
+}
+
+// Drop the blocks left to download
+func stopDownload() {
+	syncLock.Lock()
+	defer syncLock.Unlock()
+
+	blocksInTransit = [][]byte{}
+	lastHash, lastCmd = nil, ""
+}
+
+// Claim the headers or the hashes following a hash with the command
+func sendGetAfter(address, cmd string, hash []byte) error {
+	if cmd == "getblocks" {
+		return SendGetBlocksAfter(address, hash)
+	}
+	return SendGetHeadersAfter(address, hash)
+}
+
+// Loop to get the blocks from the peer into the pipe network
+func RequestBlocks() error {
+	for _, node := range knownNodes() {
+		if err := SendGetBlock(node); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ExtractCmd(request []byte) []byte {
@@ -138,369 +337,678 @@ func ExtractCmd(request []byte) []byte {
 }
 
 // Apply the mining process on the chain
-func MineTransaction(chain *blockchain.BlockChain) {
-	var txs []*blockchain.Transaction
-
-	for id := range memoryPool {
-		fmt.Printf("Tx: %s\n", memoryPool[id].ID)
-		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
-		}
+func MineTransaction(chain *blockchain.BlockChain) error {
+	// installed before the template is built, a tip connected meanwhile
+	// cancels the mining of the stale template
+	ctx, cancel := context.WithCancel(context.Background())
+	miningLock.Lock()
+	miningCancel = cancel
+	miningLock.Unlock()
+	defer stopMining()
+
+	template, err := mining.NewBlockTemplate(chain, memoryPool, MiningPolicy)
+	if err != nil {
+		return err
 	}
 
-	if len(txs) == 0 {
+	if len(template.Transactions) == 0 {
 		fmt.Printf("All transaction are invalid")
-		return
+		return nil
 	}
 
-	// add the initial transaction into the chain
-	cbTx := blockchain.CoinBaseTx(minerAddress, "")
-	txs = append(txs, cbTx)
-
-	// add new block with the transaction at the end of the chain
-	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
+	for _, tx := range template.Transactions {
+		fmt.Printf("Tx: %x\n", tx.ID)
+	}
 
-	fmt.Printf("New Block mined")
+	// the coinbase transaction must be the first of the block, it collects
+	// the fees
+	cbTx, err := template.Coinbase(minerAddress)
+	if err != nil {
+		return err
+	}
+	newBlock := template.NewBlock(cbTx)
+
+	// add new block with the transaction at the end of the chain, the
+	// memory pool is cleared once the block is connected
+	pow, err := newBlock.Mine(ctx, MinerWorkers)
+	stopMining()
+
+	if errors.Is(err, context.Canceled) {
+		// build the block again on the new tip with the transactions left
+		fmt.Println("New tip connected, mining restarted")
+		if memoryPool.Count() > 0 {
+			return MineTransaction(chain)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	// clear the memory pool
-	for _, tx := range txs {
-		txID := hex.EncodeToString(tx.ID)
-		delete(memoryPool, txID)
+	if err := chain.AddBlock(newBlock); err != nil {
+		return err
 	}
 
+	fmt.Printf("New Block mined %x\n", newBlock.Hash)
+	fmt.Printf("%d hashes in %s, %.0f H/s\n", pow.Hashes, pow.Elapsed.Round(time.Millisecond), pow.HashRate())
+
 	// push the block to all peer into the network pipe
-	for _, node := range KnownNodes {
+	for _, node := range knownNodes() {
 		if node != nodeAddress {
-			SendInventory(node, "block", [][]byte{newBlock.Hash})
+			if err := SendInventory(node, "block", [][]byte{newBlock.Hash}); err != nil {
+				return err
+			}
 		}
 	}
 
 	// recursive call of the function
-	if len(memoryPool) > 0 {
-		MineTransaction(chain)
+	if memoryPool.Count() > 0 {
+		return MineTransaction(chain)
+	}
+
+	return nil
+}
+
+// Cancel the block being mined, if any
+func stopMining() {
+	miningLock.Lock()
+	defer miningLock.Unlock()
+
+	if miningCancel != nil {
+		miningCancel()
+		miningCancel = nil
 	}
 }
 
 // Push an address into the pipe network
-func SendAddr(address string) {
-	nodes := Addr{KnownNodes}
+func SendAddr(address string) error {
+	nodes := Addr{knownNodes()}
 	nodes.AddrList = append(nodes.AddrList, nodeAddress)
-	payload := GobEncode(nodes)
-	request := append(CmdToBytes("addr"), payload...)
 
-	SendData(address, request)
+	return sendCommand(address, "addr", nodes)
 }
 
 // Push a block link into an address into the pipe network
-func SendBlock(address string, block *blockchain.Block) {
-	data := Block{nodeAddress, block.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("block"), payload...)
-
-	SendData(address, request)
+func SendBlock(address string, block *blockchain.Block) error {
+	return sendCommand(address, "block", Block{nodeAddress, block.Serialize()})
 }
 
 // Push an inventory link into an address into the pipe network
-func SendInventory(address, kind string, items [][]byte) {
-	inventory := Inventory{nodeAddress, kind, items}
-	payload := GobEncode(inventory)
-	request := append(CmdToBytes("inv"), payload...)
-
-	SendData(address, request)
+func SendInventory(address, kind string, items [][]byte) error {
+	return sendCommand(address, "inv", Inventory{nodeAddress, kind, items})
 }
 
 // Push a transaction link into an address into the pipe network
-func SendTransaction(adddress string, tnx *blockchain.Transaction) {
-	data := Tx{nodeAddress, tnx.Serialize()}
-	payload := GobEncode(data)
-	request := append(CmdToBytes("tx"), payload...)
-
-	SendData(adddress, request)
+func SendTransaction(adddress string, tnx *blockchain.Transaction) error {
+	return sendCommand(adddress, "tx", Tx{nodeAddress, tnx.Serialize()})
 }
 
 // Push the chain version number link into an address into the pipe network
-func SendVersion(address string, chain *blockchain.BlockChain) {
-	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
-
-	request := append(CmdToBytes("version"), payload...)
+func SendVersion(address string, chain *blockchain.BlockChain) error {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-	SendData(address, request)
+	return sendCommand(address, "version", Version{version, bestHeight, nodeAddress})
 }
 
 // Claim the blocks link into an address into the pipe network
-func SendGetBlock(address string) {
-	payload := GobEncode(GetBlocks{nodeAddress})
-	request := append(CmdToBytes("getblocks"), payload...)
+func SendGetBlock(address string) error {
+	return SendGetBlocksAfter(address, nil)
+}
 
-	SendData(address, request)
+// Claim the hashes following a block into the pipe network, from the genesis
+// when the peer doesn't know the block
+func SendGetBlocksAfter(address string, hash []byte) error {
+	return sendCommand(address, "getblocks", GetBlocks{nodeAddress, hash})
 }
 
-// Claim the kind of data link into an address into the pipe network
-func SendGetData(address, kind string, id []byte) {
-	payload := GobEncode(GetData{nodeAddress, kind, id})
-	request := append(CmdToBytes("getdata"), payload...)
+// Claim the headers following the tip of the chain into the pipe network
+func SendGetHeaders(address string, chain *blockchain.BlockChain) error {
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	tip, err := chain.GetBlockHashByHeight(bestHeight)
+	if err != nil {
+		return err
+	}
 
-	SendData(address, request)
+	return SendGetHeadersAfter(address, tip)
 }
 
-// Push data into the pipe network
-func SendData(addr string, data []byte) {
-	conn, err := net.Dial(protocol, addr)
+// Claim the headers following a header into the pipe network
+func SendGetHeadersAfter(address string, hash []byte) error {
+	return sendCommand(address, "getheaders", GetHeaders{nodeAddress, hash})
+}
 
+// Push block headers into an address into the pipe network
+func SendHeaders(address string, headers []blockchain.BlockHeader) error {
+	var items [][]byte
+	for i := range headers {
+		items = append(items, headers[i].Serialize())
+	}
+
+	return sendCommand(address, "headers", Headers{nodeAddress, items})
+}
+
+// Claim the proof of a transaction into the pipe network
+func SendGetProof(address string, txID []byte) error {
+	return sendCommand(address, "getproof", GetProof{nodeAddress, txID})
+}
+
+// Push the proof of a transaction into an address into the pipe network
+func SendProof(address string, proof *blockchain.TxProof) error {
+	return sendCommand(address, "proof", Proof{nodeAddress, proof.Serialize()})
+}
+
+// Claim the template of the next block from an address into the pipe network
+func SendGetBlockTemplate(address string) error {
+	return sendCommand(address, "getblocktemplate", GetBlockTemplate{nodeAddress})
+}
+
+// Push the template of the next block into an address into the pipe network
+func SendBlockTemplate(address string, template *mining.BlockTemplate) error {
+	data, err := template.Serialize()
 	if err != nil {
-		fmt.Printf("%s si not available\n", addr)
+		return err
+	}
+	return sendCommand(address, "blocktemplate", BlockTemplate{nodeAddress, data})
+}
 
-		var updateNodes []string
+// Claim the kind of data link into an address into the pipe network
+func SendGetData(address, kind string, id []byte) error {
+	return sendCommand(address, "getdata", GetData{nodeAddress, kind, id})
+}
 
-		for _, node := range KnownNodes {
-			if node != addr {
-				updateNodes = append(updateNodes, node)
-			}
-		}
+// Push data into the pipe network, an unreachable peer is removed from the
+// known nodes
+func SendData(addr string, data []byte) error {
+	conn, err := net.Dial(protocol, addr)
+
+	if err != nil {
+		fmt.Printf("%s si not available\n", addr)
 
-		KnownNodes = updateNodes
-		return
+		removeNode(addr)
+		return nil
 	}
 
 	defer conn.Close()
 
 	written, err := io.Copy(conn, bytes.NewReader(data))
-	ErrorHandler(err)
+	if err != nil {
+		return fmt.Errorf("Sending to %s: %w", addr, err)
+	}
 	fmt.Printf("Done send data size %x", written)
+
+	return nil
 }
 
-// Maintain the TCP connection and read the content
+// Maintain the TCP connection and read the content, a failing request is
+// logged and doesn't stop the node
 func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
-	request, err := ioutil.ReadAll(conn)
 	defer conn.Close()
 
-	ErrorHandler(err)
+	if err := handleRequest(conn, chain); err != nil {
+		log.Println("Request from", conn.RemoteAddr(), "failed:", err)
+	}
+}
+
+func handleRequest(conn net.Conn, chain *blockchain.BlockChain) error {
+	// a peer can't make the node read more than the largest message
+	request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	if err != nil {
+		return err
+	}
+
+	if len(request) > maxMessageSize {
+		return fmt.Errorf("Request is larger than %d bytes", maxMessageSize)
+	}
+
+	if len(request) < magicLength+commandLength {
+		return fmt.Errorf("Request of %d bytes is too short", len(request))
+	}
+
+	// drop the requests of the nodes of another network
+	if magic := binary.BigEndian.Uint32(request); magic != Params.Magic {
+		return fmt.Errorf("Request for the network %08x, this node runs %s", magic, Params.Name)
+	}
+	request = request[magicLength:]
 
 	command := BytesToCmd(request[:commandLength])
 	fmt.Printf("Received %s command\n", command)
 
 	switch command {
 	case "addr":
-		HandleAddress(request)
+		return HandleAddress(request)
 	case "block":
-		HandleBlock(request, chain)
+		return HandleBlock(request, chain)
 	case "inv":
-		HandleInventory(request, chain)
+		return HandleInventory(request, chain)
 	case "getblocks":
-		HandleGetBlocks(request, chain)
+		return HandleGetBlocks(request, chain)
 	case "getdata":
-		HanldeGetData(request, chain)
+		return HanldeGetData(request, chain)
+	case "getproof":
+		return HandleGetProof(request, chain)
+	case "proof":
+		return HandleProof(request, chain)
+	case "getblocktemplate":
+		return HandleGetBlockTemplate(request, chain)
+	case "blocktemplate":
+		return HandleBlockTemplate(request)
+	case "getheaders":
+		return HandleGetHeaders(request, chain)
+	case "headers":
+		return HandleHeaders(request, chain)
 	case "tx":
-		HandleTransaction(request, chain)
+		return HandleTransaction(request, chain)
 	case "version":
-		HanleVersion(request, chain)
+		return HanleVersion(request, chain)
 	default:
 		fmt.Printf("Unknown command %s\n", command)
 	}
+
+	return nil
 }
 
 // Handle the node address of peer into the pipe network
-func HandleAddress(request []byte) {
-	var buff bytes.Buffer
+func HandleAddress(request []byte) error {
 	var payload Addr
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes", len(KnownNodes))
-	RequestBlocks()
+	fmt.Printf("There are %d known nodes", addNodes(payload.AddrList...))
+	return RequestBlocks()
 }
 
 // Handle the add blocks into the chain from a peer into the pipe network
-func HandleBlock(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HandleBlock(request []byte, chain *blockchain.BlockChain) error {
 	var payload Block
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.Deserialize(blockData)
+	if err != nil {
+		return err
+	}
 
 	fmt.Printf("Recevied a new block")
-	chain.AddBlock(block)
+	if err := chain.AddBlock(block); errors.Is(err, blockchain.ErrBlockExists) {
+		fmt.Printf("Already have block %x\n", block.Hash)
+	} else if err != nil {
+		// the blocks built on top of a rejected block can't be valid either
+		fmt.Printf("Rejected block %x: %s\n", block.Hash, err)
+		stopDownload()
+		return nil
+	} else {
+		fmt.Printf("Added block %x\n", block.Hash)
+	}
 
-	fmt.Printf("Added block %x\n", block.Hash)
+	blockHash, cmd, after := nextDownload()
+	if blockHash != nil {
+		return SendGetData(payload.AddrFrom, "block", blockHash)
+	}
 
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
-		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
+	// the batch is downloaded, the peer has more headers or hashes
+	if after != nil {
+		return sendGetAfter(payload.AddrFrom, cmd, after)
 	}
+
+	return nil
 }
 
 // Handle claim of blocks into the chain from a peer into the pipe network
-func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) error {
 	var payload GetBlocks
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	// the peer claims the following hashes after the last one of a full
+	// inventory
+	blocks, err := chain.GetBlockHashesAfter(payload.From, blockchain.MaxInvPerMessage)
+	if err != nil {
+		return err
+	}
+
+	return SendInventory(payload.AddrFrom, "block", blocks)
+}
+
+// Handle claim of headers into the chain from a peer into the pipe network
+func HandleGetHeaders(request []byte, chain *blockchain.BlockChain) error {
+	var payload GetHeaders
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	headers, err := chain.GetHeadersAfter(payload.From, blockchain.MaxHeadersPerMessage)
+	if err != nil {
+		return err
+	}
+
+	return SendHeaders(payload.AddrFrom, headers)
+}
+
+// Handle the headers from a peer into the pipe network, the headers are
+// stored then the missing bodies are asked from the oldest one
+func HandleHeaders(request []byte, chain *blockchain.BlockChain) error {
+	var payload Headers
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	fmt.Printf("Received %d headers\n", len(payload.Headers))
+
+	newInTransit := [][]byte{}
+	accepted := 0
+	var last []byte
+	for _, data := range payload.Headers {
+		header, err := blockchain.DeserializeHeader(data)
+		if err != nil {
+			return err
+		}
+
+		// the headers following a rejected one can't connect either
+		if err := chain.AddHeader(header); err != nil {
+			fmt.Printf("Rejected header: %s\n", err)
+			break
+		}
+
+		hash := header.ComputeHash()
+		if !chain.HasBlock(hash) {
+			newInTransit = append(newInTransit, hash)
+		}
+		accepted++
+		last = hash
+	}
+
+	// a full batch leaves headers on the peer, they are claimed after the
+	// last one of the batch
+	full := len(payload.Headers) == blockchain.MaxHeadersPerMessage && accepted == len(payload.Headers)
+
+	if len(newInTransit) == 0 {
+		stopDownload()
+		if full {
+			return SendGetHeadersAfter(payload.AddrFrom, last)
+		}
+		return nil
+	}
+
+	var after []byte
+	if full {
+		after = last
+	}
+
+	return SendGetData(payload.AddrFrom, "block", startDownload(newInTransit, "getheaders", after))
+}
+
+// Handle claim of the proof of a transaction from a peer into the pipe network
+func HandleGetProof(request []byte, chain *blockchain.BlockChain) error {
+	var payload GetProof
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	proof, err := chain.GetTxProof(payload.TxID)
+	if err != nil {
+		return err
+	}
+
+	return SendProof(payload.AddrFrom, proof)
+}
+
+// Handle the proof of a transaction from a peer, it is checked against the
+// header it carries and the header against the main chain
+func HandleProof(request []byte, chain *blockchain.BlockChain) error {
+	var payload Proof
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	proof, err := blockchain.DeserializeTxProof(payload.Proof)
+	if err != nil {
+		return err
+	}
+
+	if err := chain.VerifyTxProof(proof); err != nil {
+		return fmt.Errorf("Invalid proof from %s: %w", payload.AddrFrom, err)
+	}
+
+	fmt.Printf("Transaction %x sits into block %x\n", proof.TxID, proof.BlockHash())
 
-	blocks := chain.GetBlockHashes()
-	SendInventory(payload.AddrFrom, "block", blocks)
+	return nil
+}
+
+// Handle the claim of the template of the next block from a peer, the peer
+// mines it and sends the block back
+func HandleGetBlockTemplate(request []byte, chain *blockchain.BlockChain) error {
+	var payload GetBlockTemplate
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	template, err := mining.NewBlockTemplate(chain, memoryPool, MiningPolicy)
+	if err != nil {
+		return err
+	}
+
+	return SendBlockTemplate(payload.AddrFrom, template)
+}
+
+// Handle the template of the next block from a peer
+func HandleBlockTemplate(request []byte) error {
+	var payload BlockTemplate
+
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
+
+	template, err := mining.DeserializeBlockTemplate(payload.Template)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block template at height %d on %x from %s\n", template.Height, template.PrevHash, payload.AddrFrom)
+	fmt.Printf("Transactions: %d, %d bytes, %d signatures, %d of fees\n", len(template.Transactions), template.Size, template.SigOps, template.TotalFees)
+
+	return nil
 }
 
 // Handle claim of data link into the chain from a peer into the pipe network
-func HanldeGetData(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HanldeGetData(request []byte, chain *blockchain.BlockChain) error {
 	var payload GetData
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
 	switch payload.Type {
 	case "block":
 		block, err := chain.GetBlock([]byte(payload.ID))
 		if err != nil {
-			return
+			return err
 		}
-		SendBlock(payload.AddrFrom, &block)
+		return SendBlock(payload.AddrFrom, &block)
 	case "tx":
-		txID := hex.EncodeToString(payload.ID)
-		tx := memoryPool[txID]
+		tx, ok := memoryPool.Get(payload.ID)
+		if !ok {
+			return fmt.Errorf("%w: %x", blockchain.ErrTxNotFound, payload.ID)
+		}
 
-		SendTransaction(payload.AddrFrom, &tx)
+		return SendTransaction(payload.AddrFrom, tx)
 	}
+
+	return nil
 }
 
 // Handle claim of chain version from a peer into the pipe network
-func HanleVersion(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HanleVersion(request []byte, chain *blockchain.BlockChain) error {
 	var payload Version
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
-	bestHeight := chain.GetBestHeight()
+	bestHeight, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
 	otherHeight := payload.BestHeight
 
-	if bestHeight < otherHeight {
-		SendGetBlock(payload.AddrFrom)
-	} else {
-		SendVersion(payload.AddrFrom, chain)
-	}
+	addNodes(payload.AddrFrom)
 
-	if !NodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	if bestHeight < otherHeight {
+		return SendGetHeaders(payload.AddrFrom, chain)
 	}
+	return SendVersion(payload.AddrFrom, chain)
 }
 
 // Handle add transaction into chain from a peer into the pipe network
-func HandleTransaction(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HandleTransaction(request []byte, chain *blockchain.BlockChain) error {
 	var payload Tx
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return err
+	}
+
+	// a transaction refused by the pool isn't relayed, an orphan waits into
+	// the pool for its parents
+	if _, err := memoryPool.Accept(&tx); errors.Is(err, mempool.ErrOrphan) {
+		fmt.Printf("Orphan transaction %x waits for its parents\n", tx.ID)
+		return nil
+	} else if err != nil {
+		return err
+	}
 
-	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
+	fmt.Printf("%s, %d", nodeAddress, memoryPool.Count())
 
 	// check if the node address is the main node
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
+	if nodeAddress == centralNode() {
+		for _, node := range knownNodes() {
 			if node != nodeAddress && node != payload.AddrFrom {
-				SendInventory(node, "tx", [][]byte{tx.ID})
+				if err := SendInventory(node, "tx", [][]byte{tx.ID}); err != nil {
+					return err
+				}
 			}
 		}
 	} else {
 		// apply only for all the miner node
-		if len(memoryPool) >= 2 && len(minerAddress) > 0 {
-			MineTransaction(chain)
+		if memoryPool.Count() >= 2 && len(minerAddress) > 0 {
+			return MineTransaction(chain)
 		}
 	}
+
+	return nil
 }
 
 // Handle add inventory into chain from a peer into the pipe network
-func HandleInventory(request []byte, chain *blockchain.BlockChain) {
-	var buff bytes.Buffer
+func HandleInventory(request []byte, chain *blockchain.BlockChain) error {
 	var payload Inventory
 
-	buff.Write(request[commandLength:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	ErrorHandler(err)
+	if err := Decode(request, &payload); err != nil {
+		return err
+	}
 
 	fmt.Printf("Recevied inventory with %d %s \n", len(payload.Items), payload.Type)
 
 	switch payload.Type {
 	case "block":
-		blocksInTransit = payload.Items
+		// the inventory lists the blocks from the oldest one, every block
+		// arrives after its parent
+		newInTransit := [][]byte{}
+		for _, hash := range payload.Items {
+			if !chain.HasBlock(hash) {
+				newInTransit = append(newInTransit, hash)
+			}
+		}
 
-		blockHash := payload.Items[0]
-		SendGetData(payload.AddrFrom, "block", blockHash)
+		// a full inventory leaves hashes on the peer, they are claimed after
+		// the last one
+		var after []byte
+		if len(payload.Items) == blockchain.MaxInvPerMessage {
+			after = payload.Items[len(payload.Items)-1]
+		}
 
-		newInTransit := [][]byte{}
-		for _, block := range blocksInTransit {
-			if bytes.Equal(block, blockHash) {
-				newInTransit = append(newInTransit, block)
+		if len(newInTransit) == 0 {
+			if after != nil {
+				return SendGetBlocksAfter(payload.AddrFrom, after)
 			}
+			return nil
 		}
-		blocksInTransit = newInTransit
+
+		return SendGetData(payload.AddrFrom, "block", startDownload(newInTransit, "getblocks", after))
 	case "tx":
+		if len(payload.Items) == 0 {
+			return nil
+		}
 		txID := payload.Items[0]
 
 		// check if the incomming transcation is in the memory pool, if it's not clain the transaction data
-		if memoryPool[hex.EncodeToString(txID)].ID == nil {
-			SendGetData(payload.AddrFrom, "tx", txID)
+		if !memoryPool.Has(txID) && !memoryPool.HasOrphan(txID) {
+			return SendGetData(payload.AddrFrom, "tx", txID)
 		}
 	}
 
+	return nil
 }
 
 // Start the server for a node into the peer of the network
-func StartServer(nodeID, minerAddress string) {
+func StartServer(nodeID, minerAddr string) error {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	minerAddress = minerAddress
+	minerAddress = minerAddr
 
 	// open the TCP stream
 	listener, err := net.Listen(protocol, nodeAddress)
-	ErrorHandler(err)
+	if err != nil {
+		return err
+	}
 	defer listener.Close()
 
-	chain := blockchain.CountinueBlockChain(nodeID)
-	defer chain.Database.Close()
+	chain, err := blockchain.CountinueBlockChain(Params, nodeID)
+	if err != nil {
+		return err
+	}
+	defer chain.Close()
+
+	go CloseOnSignal(listener)
 
-	go CloseDB(chain)
+	memoryPool = mempool.New(chain, MempoolPolicy)
+	chain.Subscribe(HandleChainNotification)
 
 	// check if the node address is the centralize node
-	if nodeAddress != KnownNodes[0] {
-		SendVersion(KnownNodes[0], chain)
+	if central := centralNode(); nodeAddress != central {
+		if err := SendVersion(central, chain); err != nil {
+			return err
+		}
 	}
 
 	// start loop to maintain the connection
 	for {
 		conn, err := listener.Accept()
-		ErrorHandler(err)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
 		// open a side thread by connection
 		go HandleConnection(conn, chain)
 	}
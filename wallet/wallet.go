@@ -6,8 +6,8 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"log"
 
 	"golang.org/x/crypto/ripemd160"
 )
@@ -17,43 +17,49 @@ const (
 	version        = byte(0x00)
 )
 
+var (
+	ErrInvalidAddress = errors.New("Address isn't valid")
+	ErrWalletNotFound = errors.New("Wallet is not found")
+	ErrTxNotSent      = errors.New("Transaction wasn't sent by the wallets")
+)
+
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
 }
 
-func ErrorHandler(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
-}
-
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return ecdsa.PrivateKey{}, nil, err
+	}
 
-	ErrorHandler(err)
-
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// the coordinates take the same width so the key is split in halves
+	pub := make([]byte, 64)
+	private.PublicKey.X.FillBytes(pub[:32])
+	private.PublicKey.Y.FillBytes(pub[32:])
 
-	return *private, pub
+	return *private, pub, nil
 }
 
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
+func MakeWallet() (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
 	wallet := Wallet{private, public}
 
-	return &wallet
+	return &wallet, nil
 }
 
 func PublicKeyHash(pubkey []byte) []byte {
 	pubHash := sha256.Sum256(pubkey)
 
+	// writing into a hash never fails
 	hasher := ripemd160.New()
-	_, err := hasher.Write(pubHash[:])
-
-	ErrorHandler(err)
+	hasher.Write(pubHash[:])
 
 	publicRipMD := hasher.Sum(nil)
 
@@ -87,7 +93,10 @@ func (w Wallet) Address() []byte {
 }
 
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil || len(pubKeyHash) <= checksumLength {
+		return false
+	}
 
 	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
 
@@ -99,3 +108,17 @@ func ValidateAddress(address string) bool {
 
 	return bytes.Equal(actualChecksum, targetCheckcum)
 }
+
+// Get the public key hash an address pays to
+func AddressToPubKeyHash(address string) ([]byte, error) {
+	if !ValidateAddress(address) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidAddress, address)
+	}
+
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	return pubKeyHash[1 : len(pubKeyHash)-checksumLength], nil
+}
@@ -7,35 +7,44 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets_%s.data"
-
 type Wallets struct {
 	Wallets map[string]*Wallet
+	// transactions sent by the wallets by ID, kept to bump their fee while
+	// they wait for a block
+	Sent map[string][]byte
 }
 
 // function to populate the wallets form file
-func CreateWallets(nodeID string) (*Wallets, error) {
+func CreateWallets(walletFile string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
 
-	err := wallets.LoadFromFile(nodeID)
+	err := wallets.LoadFromFile(walletFile)
 
 	return &wallets, err
 }
 
-func (ws Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
+	}
+	return *wallet, nil
 }
 
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
+func (ws *Wallets) AddWallet() (string, error) {
+	wallet, err := MakeWallet()
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.Address())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 func (ws *Wallets) GetAllAddresses() []string {
@@ -48,40 +57,68 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-func (ws *Wallets) LoadFromFile(nodeID string) error {
+func (ws *Wallets) LoadFromFile(walletFile string) error {
 	// check the current wallets file
-	walletFile := fmt.Sprintf(walletFile, nodeID)
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 
 	// open the file content
 	fileContent, err := ioutil.ReadFile(walletFile)
-	ErrorHandler(err)
+	if err != nil {
+		return err
+	}
 
 	// generate all the wallets form file content
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 
 	var wallets Wallets
-	err = decoder.Decode(&wallets)
-	ErrorHandler(err)
+	if err := decoder.Decode(&wallets); err != nil {
+		return fmt.Errorf("decoding %s: %w", walletFile, err)
+	}
 
 	ws.Wallets = wallets.Wallets
+	ws.Sent = wallets.Sent
 
 	return nil
 }
 
-func (ws *Wallets) SaveIntoFile(nodeID string) {
+// Keep a transaction sent by a wallet
+func (ws *Wallets) AddSent(txID string, tx []byte) {
+	if ws.Sent == nil {
+		ws.Sent = make(map[string][]byte)
+	}
+	ws.Sent[txID] = tx
+}
+
+// Get a transaction sent by a wallet
+func (ws Wallets) GetSent(txID string) ([]byte, error) {
+	tx, ok := ws.Sent[txID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTxNotSent, txID)
+	}
+	return tx, nil
+}
+
+// Forget a transaction sent by a wallet
+func (ws *Wallets) RemoveSent(txID string) {
+	delete(ws.Sent, txID)
+}
+
+func (ws *Wallets) SaveIntoFile(walletFile string) error {
 	var content bytes.Buffer
-	walletFile := fmt.Sprintf(walletFile, nodeID)
 
 	gob.Register(elliptic.P256())
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
-	ErrorHandler(err)
+	if err := encoder.Encode(ws); err != nil {
+		return fmt.Errorf("encoding %s: %w", walletFile, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(walletFile), 0755); err != nil {
+		return err
+	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	ErrorHandler(err)
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 }